@@ -0,0 +1,63 @@
+package slsm
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+const blockCacheShards = 16
+
+type blockKey struct {
+	id      uint64 // 区分共享缓存的不同LSM
+	fileNum uint64
+	page    int
+}
+
+// BlockCache 解码后的页缓存，按(run文件, 页号)索引，按字节数限制大小。
+// 可以在一个LSM的所有DiskLevel之间共享，也可以在多个LSM之间共享
+type BlockCache struct {
+	shards [blockCacheShards]*lruCache
+	nextID uint64
+}
+
+// NewBlockCache new
+// @param capacity - 缓存的最大字节数
+func NewBlockCache(capacity int64) *BlockCache {
+	c := &BlockCache{}
+	for i := range c.shards {
+		c.shards[i] = newLRUCache(capacity / blockCacheShards)
+	}
+	return c
+}
+
+// newID 为使用缓存的LSM分配一个ID
+func (c *BlockCache) newID() uint64 {
+	return atomic.AddUint64(&c.nextID, 1)
+}
+
+func (c *BlockCache) shard(k blockKey) *lruCache {
+	h := k.id*0x9e3779b97f4a7c15 ^ k.fileNum*0xff51afd7ed558ccd ^ uint64(k.page)
+	return c.shards[fmix64(h)%blockCacheShards]
+}
+
+func (c *BlockCache) get(k blockKey) ([]KVPair, bool) {
+	v, ok := c.shard(k).Get(k)
+	if !ok {
+		return nil, false
+	}
+	return v.([]KVPair), true
+}
+
+func (c *BlockCache) set(k blockKey, page []KVPair) {
+	charge := int64(len(page))*int64(unsafe.Sizeof(KVPair{})) + int64(unsafe.Sizeof(k))
+	c.shard(k).Set(k, page, charge)
+}
+
+// Stats 返回所有分片的命中统计
+func (c *BlockCache) Stats() CacheStats {
+	var s CacheStats
+	for _, sh := range c.shards {
+		s.add(sh)
+	}
+	return s
+}
@@ -0,0 +1,149 @@
+package slsm
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+const (
+	bloomBlockBits  = 512 // 一个cache line
+	bloomBlockWords = bloomBlockBits / 64
+	bloomBlockShift = 9 // log2(bloomBlockBits)
+
+	// bloomProbeMul 每次探测把hash乘以这个奇数，取最高的9位作为块内的位置。
+	// 双重hash(a + i·d) % 512 的探测序列是等差数列，不同key的探测位置相关性高，误判率达不到预期
+	bloomProbeMul = 0x9e3779b97f4a7c13
+
+	// blockedBloomMaxBitsPerKey 每个key最多的位数。块内的key个数不均匀，位数再多误判率也降不到任意小，
+	// p很小或p<=0时使用这么多位
+	blockedBloomMaxBitsPerKey = 64
+)
+
+// BlockedBloomFilter 分块布隆过滤器。
+// 第一个hash选块，之后的探测都落在这个64字节的块内，一次查询只有一次cache miss，也不需要对整个位数组取模
+type BlockedBloomFilter struct {
+	filterHash
+	blocks    []uint64 // 每bloomBlockWords个为一块
+	numBlocks uint64
+	numHashes uint8
+}
+
+// NewBlockedBloomFilter new
+// @param n - 预估元素个数
+// @param p - 误判率，>=1时不过滤，<=0时使用最多的位数
+func NewBlockedBloomFilter(n uint64, p float64) *BlockedBloomFilter {
+	if n == 0 || p >= 1 {
+		return &BlockedBloomFilter{}
+	}
+	ln2 := 0.693147180559945
+	denom := 0.480453013918201 // ln(2)^2
+	// 分块后各块的key个数不均匀，同样的位数误判率比普通布隆过滤器高，从普通的位数开始逐步增加直到达到p
+	bitsPerKey := float64(blockedBloomMaxBitsPerKey)
+	if p > 0 {
+		bitsPerKey = math.Min(bitsPerKey, -math.Log(p)/denom)
+	}
+	var k int
+	for {
+		k = int(math.Max(1, math.Round(bitsPerKey*ln2)))
+		if k > 1 && blockedBloomFPR(bitsPerKey, k-1) < blockedBloomFPR(bitsPerKey, k) {
+			k--
+		}
+		if bitsPerKey >= blockedBloomMaxBitsPerKey || blockedBloomFPR(bitsPerKey, k) <= p {
+			break
+		}
+		bitsPerKey = math.Min(blockedBloomMaxBitsPerKey, bitsPerKey*1.02)
+	}
+	numBlocks := uint64(math.Ceil(bitsPerKey * float64(n) / bloomBlockBits))
+	return &BlockedBloomFilter{
+		blocks:    make([]uint64, numBlocks*bloomBlockWords),
+		numBlocks: numBlocks,
+		numHashes: uint8(k),
+	}
+}
+
+// blockedBloomFPR 每个key占bitsPerKey位、k个hash时分块布隆过滤器的误判率。
+// 一块中的key个数近似服从均值为bloomBlockBits/bitsPerKey的泊松分布，块内按普通布隆过滤器计算
+func blockedBloomFPR(bitsPerKey float64, k int) float64 {
+	lambda := bloomBlockBits / bitsPerKey
+	var fpr float64
+	for j := 0; ; j++ {
+		lg, _ := math.Lgamma(float64(j + 1))
+		pj := math.Exp(-lambda + float64(j)*math.Log(lambda) - lg)
+		fpr += pj * math.Pow(1-math.Pow(1-1.0/bloomBlockBits, float64(k*j)), float64(k))
+		if float64(j) > lambda && pj < 1e-12 {
+			return fpr
+		}
+	}
+}
+
+// block 返回key所在的块，和块内探测用的hash
+func (bf *BlockedBloomFilter) block(key []byte) ([]uint64, uint64) {
+	h1, h2 := bf.sum(key)
+	// (h1 * numBlocks) >> 64 代替取模
+	hi, _ := bits.Mul64(h1, bf.numBlocks)
+	b := bf.blocks[hi*bloomBlockWords : (hi+1)*bloomBlockWords]
+	return b, h2
+}
+
+func (bf *BlockedBloomFilter) Add(key []byte) {
+	if bf.numBlocks == 0 {
+		return
+	}
+	b, h := bf.block(key)
+	for i := uint8(0); i < bf.numHashes; i++ {
+		bit := h >> (64 - bloomBlockShift)
+		h *= bloomProbeMul
+		b[bit>>6] |= 1 << (bit & 63)
+	}
+}
+
+func (bf *BlockedBloomFilter) MayContain(key []byte) bool {
+	if bf.numBlocks == 0 {
+		return true
+	}
+	b, h := bf.block(key)
+	for i := uint8(0); i < bf.numHashes; i++ {
+		bit := h >> (64 - bloomBlockShift)
+		h *= bloomProbeMul
+		if b[bit>>6]&(1<<(bit&63)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary 编码: hash函数个数(1字节) | 块数(uvarint) | 位数组(小端)
+func (bf *BlockedBloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 1+binary.MaxVarintLen64+len(bf.blocks)*8)
+	data = append(data, bf.numHashes)
+	data = appendUvarint(data, bf.numBlocks)
+	var w [8]byte
+	for _, v := range bf.blocks {
+		binary.LittleEndian.PutUint64(w[:], v)
+		data = append(data, w[:]...)
+	}
+	return data, nil
+}
+
+func (bf *BlockedBloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return errCorruptFilter
+	}
+	numHashes := data[0]
+	numBlocks, k := binary.Uvarint(data[1:])
+	if k <= 0 {
+		return errCorruptFilter
+	}
+	data = data[1+k:]
+	if uint64(len(data)) != numBlocks*bloomBlockWords*8 {
+		return errCorruptFilter
+	}
+	bf.blocks = make([]uint64, numBlocks*bloomBlockWords)
+	for i := range bf.blocks {
+		bf.blocks[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	bf.numBlocks = numBlocks
+	bf.numHashes = numHashes
+	return nil
+}
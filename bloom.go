@@ -1,7 +1,15 @@
 package slsm
 
 import (
+	"encoding/binary"
+	"errors"
 	"math"
+	"math/bits"
+)
+
+var (
+	errCorruptFilter  = errors.New("slsm: corrupt filter")
+	errFilterMismatch = errors.New("slsm: filters differ in size, hash count or hash function")
 )
 
 type BitSet struct {
@@ -40,8 +48,51 @@ func (b *BitSet) Size() uint64 {
 	return uint64(len(b.values)) * 8
 }
 
+// Count 为1的位数
+func (b *BitSet) Count() uint64 {
+	var n int
+	v := b.values
+	for ; len(v) >= 8; v = v[8:] {
+		n += bits.OnesCount64(binary.LittleEndian.Uint64(v))
+	}
+	for _, c := range v {
+		n += bits.OnesCount8(c)
+	}
+	return uint64(n)
+}
+
+// Union 按位或上other，两者大小必须相同
+func (b *BitSet) Union(other *BitSet) error {
+	if len(b.values) != len(other.values) {
+		return errFilterMismatch
+	}
+	for i, c := range other.values {
+		b.values[i] |= c
+	}
+	return nil
+}
+
+// Intersect 按位与上other，两者大小必须相同
+func (b *BitSet) Intersect(other *BitSet) error {
+	if len(b.values) != len(other.values) {
+		return errFilterMismatch
+	}
+	for i, c := range other.values {
+		b.values[i] &= c
+	}
+	return nil
+}
+
+// Reset 所有位清0
+func (b *BitSet) Reset() {
+	for i := range b.values {
+		b.values[i] = 0
+	}
+}
+
 // BloomFilter 布隆过滤器
 type BloomFilter struct {
+	filterHash
 	bitSet    *BitSet // 位数组
 	numHashes uint8   // hash函数个数
 }
@@ -61,7 +112,7 @@ func NewBloomFilter(n uint64, p float64) *BloomFilter {
 }
 
 func (bf *BloomFilter) BloomHash(data []byte) (uint64, uint64) {
-	return MurmurHash3_x64_128(data, 0)
+	return bf.sum(data)
 }
 
 // Add 增加元素
@@ -85,3 +136,116 @@ func (bf *BloomFilter) MayContain(data []byte) bool {
 	}
 	return true
 }
+
+// compatible 位数、hash函数个数、hash函数和种子都相同的过滤器才能做集合运算
+func (bf *BloomFilter) compatible(other *BloomFilter) bool {
+	id, otherID := Murmur3Hash, Murmur3Hash
+	if bf.hasher != nil {
+		id = bf.hasher.ID()
+	}
+	if other.hasher != nil {
+		otherID = other.hasher.ID()
+	}
+	return bf.numHashes == other.numHashes && bf.bitSet.Size() == other.bitSet.Size() &&
+		id == otherID && bf.hashSeed == other.hashSeed
+}
+
+// Union 合并other，结果包含两者的所有元素
+func (bf *BloomFilter) Union(other *BloomFilter) error {
+	if !bf.compatible(other) {
+		return errFilterMismatch
+	}
+	return bf.bitSet.Union(other.bitSet)
+}
+
+// Intersect 与other求交。结果包含两者共有的元素，
+// 但误判率比直接用共有元素构建的过滤器高
+func (bf *BloomFilter) Intersect(other *BloomFilter) error {
+	if !bf.compatible(other) {
+		return errFilterMismatch
+	}
+	return bf.bitSet.Intersect(other.bitSet)
+}
+
+// Reset 清空所有元素
+func (bf *BloomFilter) Reset() {
+	bf.bitSet.Reset()
+}
+
+// EstimatedCount 根据为1的位数估计加入的不同元素个数: -m/k * ln(1 - X/m)
+func (bf *BloomFilter) EstimatedCount() uint64 {
+	m := float64(bf.bitSet.Size())
+	x := float64(bf.bitSet.Count())
+	if m == 0 || bf.numHashes == 0 {
+		return 0
+	}
+	if x >= m {
+		return math.MaxUint64
+	}
+	return uint64(math.Round(-m / float64(bf.numHashes) * math.Log(1-x/m)))
+}
+
+// FalsePositiveRate 根据为1的位数估计当前的误判率: (X/m)^k
+func (bf *BloomFilter) FalsePositiveRate() float64 {
+	m := float64(bf.bitSet.Size())
+	if m == 0 {
+		return 1
+	}
+	return math.Pow(float64(bf.bitSet.Count())/m, float64(bf.numHashes))
+}
+
+// BloomStats 一组布隆过滤器根据位数组估计的统计
+type BloomStats struct {
+	Filters           int     // 布隆过滤器个数
+	EstimatedCount    uint64  // 估计的元素个数之和
+	FalsePositiveRate float64 // 平均的估计误判率
+}
+
+// add 累加f的统计，不是BloomFilter时忽略
+func (s *BloomStats) add(f Filter) {
+	bf, ok := f.(*BloomFilter)
+	if !ok {
+		return
+	}
+	s.FalsePositiveRate = (s.FalsePositiveRate*float64(s.Filters) + bf.FalsePositiveRate()) / float64(s.Filters+1)
+	s.Filters++
+	s.EstimatedCount += bf.EstimatedCount()
+}
+
+// MarshalBinary 编码: 字节数(uvarint) | 位数组
+func (b *BitSet) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, binary.MaxVarintLen64+len(b.values))
+	data = appendUvarint(data, uint64(len(b.values)))
+	return append(data, b.values...), nil
+}
+
+func (b *BitSet) UnmarshalBinary(data []byte) error {
+	n, k := binary.Uvarint(data)
+	if k <= 0 || uint64(len(data)-k) != n {
+		return errCorruptFilter
+	}
+	b.values = append([]byte(nil), data[k:]...)
+	return nil
+}
+
+// MarshalBinary 编码: hash函数个数(1字节) | BitSet
+func (bf *BloomFilter) MarshalBinary() ([]byte, error) {
+	bits, err := bf.bitSet.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{bf.numHashes}, bits...), nil
+}
+
+func (bf *BloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return errCorruptFilter
+	}
+	bitSet := &BitSet{}
+	if err := bitSet.UnmarshalBinary(data[1:]); err != nil {
+		return err
+	}
+	bf.numHashes = data[0]
+	bf.bitSet = bitSet
+	return nil
+}
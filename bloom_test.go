@@ -0,0 +1,161 @@
+package slsm
+
+import (
+	"math"
+	"testing"
+)
+
+// newTestBloom 返回加入了[lo, hi)的布隆过滤器
+func newTestBloom(lo, hi int) *BloomFilter {
+	bf := NewBloomFilter(10000, 0.01)
+	for k := lo; k < hi; k++ {
+		bf.Add(encodeInt(k))
+	}
+	return bf
+}
+
+func TestBloomUnionIntersect(t *testing.T) {
+	u := newTestBloom(0, 3000)
+	if err := u.Union(newTestBloom(3000, 6000)); err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 6000; k++ {
+		if !u.MayContain(encodeInt(k)) {
+			t.Fatalf("union lost %v", k)
+		}
+	}
+	if n := u.EstimatedCount(); math.Abs(float64(n)-6000) > 6000*0.05 {
+		t.Fatalf("union estimated count %v", n)
+	}
+
+	i := newTestBloom(0, 4000)
+	if err := i.Intersect(newTestBloom(2000, 6000)); err != nil {
+		t.Fatal(err)
+	}
+	for k := 2000; k < 4000; k++ {
+		if !i.MayContain(encodeInt(k)) {
+			t.Fatalf("intersection lost %v", k)
+		}
+	}
+	falsePositives := 0
+	for k := 0; k < 2000; k++ {
+		if i.MayContain(encodeInt(k)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 200 {
+		t.Fatalf("intersection passes %v of 2000 removed keys", falsePositives)
+	}
+	if i.FalsePositiveRate() >= u.FalsePositiveRate() {
+		t.Fatalf("intersection fpr %v >= union fpr %v", i.FalsePositiveRate(), u.FalsePositiveRate())
+	}
+}
+
+func TestBloomMismatch(t *testing.T) {
+	seeded := newTestBloom(0, 0)
+	seeded.SetHasher(nil, 1)
+	hashed := newTestBloom(0, 0)
+	hashed.SetHasher(XXHasher{}, 0)
+	hashes := newTestBloom(0, 0)
+	hashes.numHashes++
+	for name, other := range map[string]*BloomFilter{
+		"size":   NewBloomFilter(100, 0.01),
+		"hashes": hashes,
+		"seed":   seeded,
+		"hasher": hashed,
+	} {
+		bf := newTestBloom(0, 1000)
+		before := bf.bitSet.Count()
+		if err := bf.Union(other); err != errFilterMismatch {
+			t.Fatalf("%v: union err %v", name, err)
+		}
+		if err := bf.Intersect(other); err != errFilterMismatch {
+			t.Fatalf("%v: intersect err %v", name, err)
+		}
+		if bf.bitSet.Count() != before {
+			t.Fatalf("%v: filter changed after mismatch", name)
+		}
+	}
+	if err := NewBitSet(64).Union(NewBitSet(128)); err != errFilterMismatch {
+		t.Fatalf("bitset union err %v", err)
+	}
+	if err := NewBitSet(64).Intersect(NewBitSet(128)); err != errFilterMismatch {
+		t.Fatalf("bitset intersect err %v", err)
+	}
+}
+
+func TestBloomEstimates(t *testing.T) {
+	bf := newTestBloom(0, 10000)
+	if n := bf.EstimatedCount(); math.Abs(float64(n)-10000) > 10000*0.03 {
+		t.Fatalf("estimated count %v", n)
+	}
+	falsePositives := 0
+	for k := 10000; k < 110000; k++ {
+		if bf.MayContain(encodeInt(k)) {
+			falsePositives++
+		}
+	}
+	// 按设计的元素个数加满时接近构造时的误判率
+	measured := float64(falsePositives) / 100000
+	if est := bf.FalsePositiveRate(); est < 0.005 || est > 0.015 || math.Abs(est-measured) > 0.3*est {
+		t.Fatalf("estimated fpr %v, measured %v", est, measured)
+	}
+
+	bf.Reset()
+	if bf.EstimatedCount() != 0 || bf.FalsePositiveRate() != 0 || bf.MayContain(encodeInt(1)) {
+		t.Fatalf("reset filter count %v fpr %v", bf.EstimatedCount(), bf.FalsePositiveRate())
+	}
+
+	// 全部为1时元素个数无法估计
+	full := NewBloomFilter(1, 0.5)
+	for k := 0; full.bitSet.Count() < full.bitSet.Size(); k++ {
+		full.Add(encodeInt(k))
+	}
+	if full.EstimatedCount() != math.MaxUint64 || full.FalsePositiveRate() != 1 {
+		t.Fatalf("full filter count %v fpr %v", full.EstimatedCount(), full.FalsePositiveRate())
+	}
+}
+
+func TestBloomStatsLazyFilters(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 64
+	o.NumRuns = 2
+	o.PageSize = 16
+	o.LazyLoadFilter = true
+	lsm := NewLSMWithOptions(o)
+	for i := 0; i < 2000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	waitCompactions(lsm)
+	var filters int
+	for _, s := range lsm.BloomStats()[1:] {
+		filters += s.Filters
+	}
+	if filters == 0 {
+		t.Fatalf("no filters of newly written runs counted")
+	}
+	lsm.Close()
+
+	lsm = NewLSMWithOptions(o)
+	defer lsm.Close()
+	stats := lsm.BloomStats()
+	for i, s := range stats[1:] {
+		if s.Filters != 0 {
+			t.Fatalf("level %v: %v unloaded filters counted", i+1, s.Filters)
+		}
+	}
+	if loaded, _ := loadedFilters(lsm); loaded != 0 {
+		t.Fatalf("BloomStats loaded %v filters", loaded)
+	}
+
+	lsm.Lookup(0)
+	loaded, _ := loadedFilters(lsm)
+	filters = 0
+	for _, s := range lsm.BloomStats()[1:] {
+		filters += s.Filters
+	}
+	if loaded == 0 || filters != loaded {
+		t.Fatalf("%v filters counted, %v loaded", filters, loaded)
+	}
+}
@@ -0,0 +1,506 @@
+package slsm
+
+import (
+	"context"
+	"math"
+)
+
+// CompactionPolicy 合并策略，决定每层是分层(tiering)还是分级(leveling)。
+// 分层的一层有多个run，合并进来的数据追加为一个新run，run个数达到上限时合并到下一层，写放大小；
+// 分级的一层只有一个run，合并进来的数据和它合成一个，元素个数超过本层容量时合并到下一层，读放大小
+type CompactionPolicy interface {
+	// Leveled 第level层(从1开始)是否分级。lastLevel表示是否是目前最下面一层
+	Leveled(level int, lastLevel bool) bool
+}
+
+// TieringPolicy 所有层都分层，默认的策略
+type TieringPolicy struct{}
+
+func (TieringPolicy) Leveled(level int, lastLevel bool) bool {
+	return false
+}
+
+// LevelingPolicy 所有层都分级
+type LevelingPolicy struct{}
+
+func (LevelingPolicy) Leveled(level int, lastLevel bool) bool {
+	return true
+}
+
+// LazyLevelingPolicy 只有最下面一层分级，其他层分层(Dostoevsky, Dayan et al., SIGMOD'18)。
+// 大部分数据在最下面一层，点查询和范围查询接近分级，写放大接近分层
+type LazyLevelingPolicy struct{}
+
+func (LazyLevelingPolicy) Leveled(level int, lastLevel bool) bool {
+	return lastLevel
+}
+
+// leveled 下标为i的磁盘层是否分级
+func (lsm *LSM) leveled(i int) bool {
+	policy := lsm.opts.CompactionPolicy
+	if policy == nil {
+		return false
+	}
+	return policy.Leveled(lsm.diskLevels[i].level, i == len(lsm.diskLevels)-1)
+}
+
+// canMove runs能否不改写文件直接移到下标为i的层，只需要修改manifest：
+// 分层的层只移一个run；分区的分级层要求移动后层内的文件仍然两两不重叠；不分区的分级层要求层为空且只有一个run。
+// 移动的文件保留原来的格式(压缩、过滤器误判率)
+func (lsm *LSM) canMove(i int, runs []*DiskRun) bool {
+	dl := lsm.diskLevels[i]
+	if !lsm.leveled(i) || lsm.opts.PartitionSize == 0 {
+		return len(runs) == 1 && (!lsm.leveled(i) || dl.LevelEmpty())
+	}
+	for _, r := range runs {
+		if r.GetCapacity() > lsm.opts.PartitionSize {
+			return false
+		}
+	}
+	return runsDisjoint(sortRuns(append(append([]*DiskRun{}, dl.runs...), runs...)))
+}
+
+// partitioned 下标为i的层是否是文件两两不重叠的分区分级层
+func (lsm *LSM) partitioned(i int) bool {
+	return lsm.leveled(i) && lsm.opts.PartitionSize > 0 && lsm.diskLevels[i].disjoint()
+}
+
+// dynamicLevels 是否按最下面一层的实际大小推算各层的目标大小，只在最下面一层分级时起作用
+func (lsm *LSM) dynamicLevels() bool {
+	return lsm.opts.DynamicLevelSizing && lsm.leveled(len(lsm.diskLevels)-1)
+}
+
+// levelCapacity 下标为i的分级层最多容纳的kv个数。
+// 动态层大小时最下面一层不限大小，往上每层是下一层实际大小的1/T，但不小于创建时的容量
+func (lsm *LSM) levelCapacity(i int) uint64 {
+	dl := lsm.diskLevels[i]
+	if !lsm.dynamicLevels() {
+		return dl.capacity()
+	}
+	bi := len(lsm.diskLevels) - 1
+	if i == bi {
+		return math.MaxUint64
+	}
+	target := float64(lsm.diskLevels[bi].GetElementsNum())
+	for j := bi - 1; j >= i; j-- {
+		target /= float64(lsm.diskLevels[j].mergeSize)
+	}
+	if target < float64(dl.capacity()) {
+		return dl.capacity()
+	}
+	return uint64(target)
+}
+
+// levelsNeeded 动态层大小时，最下面一层有n个kv需要的层数：第1层的目标大小在[创建时的容量, 创建时的容量*T)之间
+func (lsm *LSM) levelsNeeded(n float64) int {
+	base := float64(lsm.diskLevels[0].capacity())
+	t := float64(lsm.diskLevels[0].mergeSize)
+	levels := 1
+	for ; n >= base*t; n /= t {
+		levels++
+	}
+	return levels
+}
+
+// planResize 动态层大小时规划增减层：最下面一层需要更多层时把它整层移到新增的一层；
+// 最下面一层比需要的小了T倍时，先把上一层合并下去，再把它整层移到空了的上一层并删掉最下面一层。
+// 移动只修改manifest。必须持有diskMu的写锁
+func (lsm *LSM) planResize() *compaction {
+	if !lsm.dynamicLevels() {
+		return nil
+	}
+	bi := len(lsm.diskLevels) - 1
+	bottom := lsm.diskLevels[bi]
+	n := float64(bottom.GetElementsNum())
+	switch {
+	case lsm.levelsNeeded(n) > len(lsm.diskLevels):
+		lsm.addDiskLevel()
+		return &compaction{src: bottom, dst: lsm.diskLevels[bi+1], inputs: append([]*DiskRun{}, bottom.runs...),
+			move: true, lo: math.MinInt, hi: math.MaxInt}
+	case bi > 0 && lsm.levelsNeeded(n*float64(bottom.mergeSize)) < len(lsm.diskLevels):
+		above := lsm.diskLevels[bi-1]
+		if !above.LevelEmpty() {
+			return lsm.planMerge(bi, append([]*DiskRun{}, above.runs...), nil)
+		}
+		return &compaction{src: bottom, dst: above, inputs: append([]*DiskRun{}, bottom.runs...),
+			move: true, removeSrc: true, lo: math.MinInt, hi: math.MaxInt}
+	}
+	return nil
+}
+
+// levelFull 下标为i的磁盘层放不下再合并进来的incoming个kv，需要先合并到下一层
+func (lsm *LSM) levelFull(i int, incoming uint64) bool {
+	dl := lsm.diskLevels[i]
+	if lsm.leveled(i) {
+		return !dl.LevelEmpty() && dl.GetElementsNum()+incoming > lsm.levelCapacity(i)
+	}
+	return dl.LevelFull()
+}
+
+// compactionScore 下标为i的层满的程度，不小于1时需要合并到下一层
+func (lsm *LSM) compactionScore(i int) float64 {
+	dl := lsm.diskLevels[i]
+	if lsm.leveled(i) {
+		return float64(dl.GetElementsNum()) / float64(lsm.levelCapacity(i))
+	}
+	return float64(len(dl.runs)) / float64(dl.numRuns)
+}
+
+// selectInputs 选出下标为i的层要合并到下一层的run：分层的层合并最旧的mergeSize个run；
+// 分区的分级层只合并腾出need个kv的空间所需的文件，下一层还不存在时整层合并；其他分级的层整层合并。
+// 要在增加新层之前选，懒分级时原来的最下面一层增加新层后就变成分层了
+func (lsm *LSM) selectInputs(i int, need uint64) []*DiskRun {
+	src := lsm.diskLevels[i]
+	switch {
+	case !lsm.leveled(i):
+		return src.GetRunsToMerge()
+	case lsm.opts.PartitionSize > 0 && i+1 < len(lsm.diskLevels) && src.disjoint():
+		var excess uint64
+		if total, capacity := src.GetElementsNum()+need, lsm.levelCapacity(i); total > capacity {
+			excess = total - capacity
+		}
+		return src.PickFilesToMerge(excess)
+	default:
+		return append([]*DiskRun{}, src.runs...)
+	}
+}
+
+// compaction 一次合并：把上一层的inputs(合并内存run时是kvs)合并或移动到dst层，改写dst中的replaced。
+// 规划和安装时持有diskMu的写锁，中间写新文件时不加锁，查找和其他不冲突的合并可以继续
+type compaction struct {
+	src      *DiskLevel // nil表示合并内存run，或者只改写dst
+	dst      *DiskLevel
+	inputs   []*DiskRun
+	kvs      []KVPair
+	replaced []*DiskRun
+	capacity uint64 // inputs或kvs中kv个数之和
+
+	move          bool   // 不改写文件，直接把inputs移到dst
+	partitionSize uint64 // 大于0时按分区写多个文件
+	bounds        []int  // 分区时新文件不能跨过的key
+	drop          bool   // 丢弃删除标记
+
+	// 占用的key范围，src和dst中与它重叠的run不能被其他合并改写。
+	// 只有分区的分级层之间的合并只占用涉及的范围，其他合并占用整层
+	lo, hi int
+
+	added     []*DiskRun
+	removeSrc bool         // 安装后删除空了的src，src是最下面一层
+	through   []*DiskLevel // src和dst之间跳过的层，合并期间也被占用
+
+	// 合并内存run时使用
+	done         chan struct{} // 安装后关闭
+	ready        bool          // kvs已经合并好
+	pendingBytes uint64        // 计入等待合并字节数的大小
+}
+
+// cover 把[lo, hi]加入占用的key范围
+func (c *compaction) cover(lo, hi int) {
+	if lo < c.lo {
+		c.lo = lo
+	}
+	if hi > c.hi {
+		c.hi = hi
+	}
+}
+
+// planMerge 规划把上一层的inputs或内存run合并后的kvs合并到下标为i的层，必须持有diskMu的写锁
+func (lsm *LSM) planMerge(i int, inputs []*DiskRun, kvs []KVPair) *compaction {
+	dst := lsm.diskLevels[i]
+	c := &compaction{dst: dst, inputs: inputs, kvs: kvs}
+	var ranges [][2]int
+	if len(kvs) > 0 {
+		ranges = append(ranges, [2]int{kvs[0].Key, kvs[len(kvs)-1].Key})
+		c.capacity = uint64(len(kvs))
+	}
+	for _, r := range inputs {
+		ranges = append(ranges, [2]int{r.minKey, r.maxKey})
+		c.capacity += r.GetCapacity()
+	}
+	narrow := lsm.partitioned(i)
+	if i > 0 && kvs == nil {
+		c.src = lsm.diskLevels[i-1]
+		narrow = narrow && lsm.partitioned(i-1)
+	}
+
+	bottom := i == len(lsm.diskLevels)-1
+	switch {
+	case kvs == nil && lsm.canMove(i, inputs):
+		c.move = true
+	case lsm.leveled(i) && lsm.opts.PartitionSize > 0:
+		var kept []*DiskRun
+		c.replaced, kept = dst.partitionReplaced(ranges)
+		c.partitionSize, c.bounds, c.drop = lsm.opts.PartitionSize, partitionBounds(kept), bottom
+	case lsm.leveled(i):
+		c.replaced, c.drop = append([]*DiskRun{}, dst.runs...), bottom
+	default:
+		c.drop = bottom && dst.LevelEmpty()
+	}
+
+	c.lo, c.hi = math.MinInt, math.MaxInt
+	if narrow {
+		c.lo, c.hi = math.MaxInt, math.MinInt
+		for _, rg := range ranges {
+			c.cover(rg[0], rg[1])
+		}
+		for _, r := range c.replaced {
+			c.cover(r.minKey, r.maxKey)
+		}
+	}
+	return c
+}
+
+// planRewrite 规划把倒数第二层的inputs(可以为空)和最下面一层中与inputs或[lo, hi]重叠的run合并，并丢弃删除标记。
+// 不管最下面一层是否分级都改写重叠的run，必须持有diskMu的写锁
+func (lsm *LSM) planRewrite(lo, hi int, inputs []*DiskRun) *compaction {
+	bi := len(lsm.diskLevels) - 1
+	dst := lsm.diskLevels[bi]
+	c := &compaction{dst: dst, inputs: inputs, drop: true, lo: math.MinInt, hi: math.MaxInt}
+	ranges := [][2]int{{lo, hi}}
+	for _, r := range inputs {
+		ranges = append(ranges, [2]int{r.minKey, r.maxKey})
+		c.capacity += r.GetCapacity()
+	}
+	if len(inputs) > 0 {
+		c.src = lsm.diskLevels[bi-1]
+	}
+	switch {
+	case lsm.leveled(bi) && lsm.opts.PartitionSize > 0:
+		var kept []*DiskRun
+		c.replaced, kept = dst.partitionReplaced(ranges)
+		c.partitionSize, c.bounds = lsm.opts.PartitionSize, partitionBounds(kept)
+		if len(inputs) == 0 && lsm.partitioned(bi) {
+			c.lo, c.hi = runsHull(c.replaced)
+		}
+	default:
+		for _, r := range inputs {
+			if r.minKey < lo {
+				lo = r.minKey
+			}
+			if r.maxKey > hi {
+				hi = r.maxKey
+			}
+		}
+		c.replaced = dst.overlapping(lo, hi)
+	}
+	return c
+}
+
+// planDropTombstones 规划丢弃下标为i的层中第idx个run的删除标记，不会增加层：
+// 下面的层和本层的其他run都不与它重叠时原地改写；只有最下面一层与它重叠、本层也没有比它旧的run与它重叠时，
+// 直接和最下面一层中与它重叠的run合并。否则返回nil，等常规的合并把它推下去。必须持有diskMu的写锁
+func (lsm *LSM) planDropTombstones(i, idx int) *compaction {
+	dl := lsm.diskLevels[i]
+	r := dl.runs[idx]
+	rg := [][2]int{{r.minKey, r.maxKey}}
+	newer := false
+	for j, o := range dl.runs {
+		if j == idx || o.GetCapacity() == 0 || !o.overlaps(rg) {
+			continue
+		}
+		if j < idx {
+			return nil // 丢弃删除标记后旧的值会重新出现
+		}
+		newer = true
+	}
+	below := -1 // 最上面一个与r重叠的下层
+	for j := i + 1; j < len(lsm.diskLevels) && below < 0; j++ {
+		if len(lsm.diskLevels[j].overlapping(r.minKey, r.maxKey)) > 0 {
+			below = j
+		}
+	}
+
+	bi := len(lsm.diskLevels) - 1
+	var c *compaction
+	switch {
+	case below < 0 && !newer:
+		// 原地改写，新文件加在本层最后，不能有比它新的run与它重叠
+		c = &compaction{dst: dl}
+	case below == bi:
+		c = &compaction{src: dl, dst: lsm.diskLevels[bi], inputs: []*DiskRun{r}, capacity: r.GetCapacity(),
+			through: append([]*DiskLevel{}, lsm.diskLevels[i+1:bi]...)}
+	default:
+		return nil
+	}
+	c.drop = true
+	c.lo, c.hi = math.MinInt, math.MaxInt
+	j := i
+	if c.src != nil {
+		j = bi
+	}
+	if lsm.leveled(j) && lsm.opts.PartitionSize > 0 {
+		var kept []*DiskRun
+		c.replaced, kept = c.dst.partitionReplaced(rg)
+		c.partitionSize, c.bounds = lsm.opts.PartitionSize, partitionBounds(kept)
+	} else if c.src != nil {
+		c.replaced = c.dst.overlapping(r.minKey, r.maxKey)
+	} else {
+		c.replaced = []*DiskRun{r}
+	}
+	return c
+}
+
+// runCompaction 写合并后的新文件，不修改磁盘层，不需要持有diskMu。
+// replaced比inputs旧，inputs按从旧到新排列
+func (lsm *LSM) runCompaction(c *compaction) {
+	if c.move {
+		return
+	}
+	its := make([]kvIterator, 0, len(c.replaced)+len(c.inputs)+1)
+	capacity := c.capacity
+	for _, r := range c.replaced {
+		its = append(its, c.dst.mergeIterator(r))
+		capacity += r.GetCapacity()
+	}
+	for _, r := range c.inputs {
+		its = append(its, c.dst.mergeIterator(r))
+	}
+	if c.kvs != nil {
+		its = append(its, &sliceIterator{kvs: c.kvs})
+	}
+
+	var run *DiskRun
+	switch {
+	case c.partitionSize > 0:
+		c.added = c.dst.writePartitions(lsm.manifest.NewFileNum, its, capacity, c.partitionSize, c.bounds, c.drop)
+		return
+	case len(c.replaced) == 0 && c.kvs != nil && !c.drop:
+		run = c.dst.writeRun(lsm.manifest.NewFileNum(), c.kvs)
+	case len(c.replaced) == 0 && c.kvs == nil:
+		run = c.dst.writeRuns(lsm.manifest.NewFileNum(), c.inputs, c.drop)
+	default:
+		run = c.dst.writeMerged(lsm.manifest.NewFileNum(), its, capacity, c.drop)
+	}
+	if run != nil {
+		c.added = append(c.added, run)
+	}
+}
+
+// installCompaction 用合并结果替换磁盘层中的run并写入manifest，必须持有diskMu的写锁
+// @return 新写入的kv个数
+func (lsm *LSM) installCompaction(c *compaction) uint64 {
+	c.dst.FreeMergedRuns(c.replaced)
+	var moved []*DiskRun
+	if c.move {
+		moved = c.inputs
+		for _, r := range moved {
+			c.dst.appendRun(r)
+		}
+	}
+	for _, r := range c.added {
+		c.dst.appendRun(r)
+	}
+	src, merged := c.dst, []*DiskRun(nil)
+	if c.src != nil {
+		src, merged = c.src, c.src.FreeMergedRuns(c.inputs)
+	}
+	written := lsm.logMerge(src, c.dst, c.added, moved, merged, c.replaced)
+	if c.removeSrc {
+		lsm.diskLevels = lsm.diskLevels[:len(lsm.diskLevels)-1]
+	}
+	return written
+}
+
+// CompactionProgress 手动合并的进度，每合并完一层回调一次
+type CompactionProgress struct {
+	Level       int    // 刚合并完的层(从1开始)
+	NumLevels   int    // 当前的磁盘层数
+	KeysWritten uint64 // 目前为止写入的kv个数
+}
+
+// CompactRange 在后台把磁盘上与[start, end)重叠的数据逐层合并到最下面一层，
+// 丢弃被覆盖的旧版本，最下面一层的删除标记也一起丢弃。调用前已经写满交给后台合并的内存run先写入第1层再开始，
+// 还在内存run中的数据不参与。每合并完一层调用一次progress(可以为nil)；ctx取消后合并完当前层就停止，
+// 已完成的部分保留。返回的channel在结束时收到nil或ctx的错误
+func (lsm *LSM) CompactRange(ctx context.Context, start, end int, progress func(CompactionProgress)) <-chan error {
+	if end <= start {
+		done := make(chan error, 1)
+		done <- nil
+		return done
+	}
+	return lsm.compactInBackground(ctx, start, end-1, progress)
+}
+
+// CompactAll 在后台把磁盘上的所有数据合并到最下面一层，见CompactRange
+func (lsm *LSM) CompactAll(ctx context.Context, progress func(CompactionProgress)) <-chan error {
+	return lsm.compactInBackground(ctx, math.MinInt, math.MaxInt, progress)
+}
+
+func (lsm *LSM) compactInBackground(ctx context.Context, lo, hi int, progress func(CompactionProgress)) <-chan error {
+	done := make(chan error, 1)
+	flushes := lsm.sched.flushesDone()
+	lsm.compactWg.Add(1)
+	go func() {
+		defer lsm.compactWg.Done()
+		for _, f := range flushes {
+			select {
+			case <-f:
+			case <-ctx.Done():
+				done <- ctx.Err()
+				return
+			}
+		}
+		done <- lsm.compactRange(ctx, lo, hi, progress)
+	}()
+	return done
+}
+
+// compactRange 从第1层开始，每次把一层中与[lo, hi]重叠的run合并到下一层，
+// 层与层之间查找和内存run的合并可以继续
+func (lsm *LSM) compactRange(ctx context.Context, lo, hi int, progress func(CompactionProgress)) error {
+	var p CompactionProgress
+	for level := 1; ; level++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		written, numLevels, last := lsm.compactLevel(level, lo, hi)
+		p.Level = level
+		p.NumLevels = numLevels
+		p.KeysWritten += written
+		if progress != nil {
+			progress(p)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// compactLevel 把第level层(从1开始)中与[lo, hi]重叠的run合并到下一层。
+// 下一层是最下面一层时，和它重叠的run一起改写并丢弃删除标记，last返回true。
+// 暂停后台合并独占磁盘层，同后台合并一样只在规划和安装时持有diskMu，写新文件时查找可以继续
+func (lsm *LSM) compactLevel(level int, lo, hi int) (written uint64, numLevels int, last bool) {
+	lsm.sched.pause()
+	defer lsm.sched.resume()
+	lsm.diskMu.Lock()
+	c, numLevels, last := lsm.planCompactLevel(level, lo, hi)
+	lsm.diskMu.Unlock()
+	if c == nil {
+		return 0, numLevels, last
+	}
+	lsm.runCompaction(c)
+	lsm.diskMu.Lock()
+	written = lsm.installCompaction(c)
+	lsm.diskMu.Unlock()
+	return written, numLevels, last
+}
+
+// planCompactLevel 规划compactLevel的合并，没有要合并的run时返回nil。必须持有diskMu的写锁
+func (lsm *LSM) planCompactLevel(level int, lo, hi int) (c *compaction, numLevels int, last bool) {
+	numLevels = len(lsm.diskLevels)
+	var runs []*DiskRun
+	if level < numLevels {
+		runs = lsm.diskLevels[level-1].overlapping(lo, hi)
+	}
+	if level+1 >= numLevels {
+		c = lsm.planRewrite(lo, hi, runs)
+		if len(c.inputs) == 0 && len(c.replaced) == 0 {
+			return nil, numLevels, true
+		}
+		return c, numLevels, true
+	}
+	if len(runs) == 0 {
+		return nil, numLevels, false
+	}
+	return lsm.planMerge(level, runs, nil), numLevels, false
+}
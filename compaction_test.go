@@ -0,0 +1,330 @@
+package slsm
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// waitCompactions 等后台合并空闲一段时间
+func waitCompactions(lsm *LSM) {
+	lsm.mergeWg.Wait()
+	for idle := 0; idle < 10; {
+		time.Sleep(10 * time.Millisecond)
+		s := lsm.sched
+		s.mu.Lock()
+		if len(s.running) == 0 && len(s.flushes) == 0 {
+			idle++
+		} else {
+			idle = 0
+		}
+		s.mu.Unlock()
+	}
+}
+
+// 反复写入再删除，删除标记比例高的run丢弃删除标记时不能增加层
+func TestTombstoneCompactionDoesNotAddLevels(t *testing.T) {
+	for _, policy := range []CompactionPolicy{TieringPolicy{}, LazyLevelingPolicy{}} {
+		levels := make(map[float64]int)
+		for _, ratio := range []float64{0, 0.3} {
+			o := DefaultOptions()
+			o.Dir = t.TempDir()
+			o.EltsPerRun = 100
+			o.NumRuns = 4
+			o.DiskRunsPerLevel = 4
+			o.PageSize = 64
+			o.CompactionPolicy = policy
+			o.TombstoneCompactionRatio = ratio
+			lsm := NewLSMWithOptions(o)
+			for round := 0; round < 6; round++ {
+				for i := 0; i < 20000; i++ {
+					lsm.InsertKey(round*100000+i, i)
+				}
+				for i := 0; i < 20000; i++ {
+					if i%100 != 0 {
+						lsm.DeleteKey(round*100000 + i)
+					}
+				}
+			}
+			waitCompactions(lsm)
+			for round := 0; round < 6; round++ {
+				for i := 0; i < 20000; i += 7 {
+					if _, ok := lsm.Lookup(round*100000 + i); ok != (i%100 == 0) {
+						t.Fatalf("%T ratio %v: lookup %v = %v", policy, ratio, round*100000+i, ok)
+					}
+				}
+			}
+			lsm.diskMu.RLock()
+			levels[ratio] = len(lsm.diskLevels)
+			var tombstones uint64
+			for _, dl := range lsm.diskLevels {
+				tombstones += dl.GetTombstonesNum()
+			}
+			lsm.diskMu.RUnlock()
+			lsm.Close()
+			if ratio > 0 && tombstones > 0 {
+				t.Errorf("%T: %v tombstones left", policy, tombstones)
+			}
+		}
+		if levels[0.3] > levels[0] {
+			t.Errorf("%T: %v levels with tombstone compaction, %v without", policy, levels[0.3], levels[0])
+		}
+	}
+}
+
+// checkCompacted 检查磁盘上与[lo, hi]重叠的数据都在最下面一层，最下面一层没有删除标记
+func checkCompacted(t *testing.T, lsm *LSM, lo, hi int) {
+	t.Helper()
+	lsm.diskMu.RLock()
+	defer lsm.diskMu.RUnlock()
+	bi := len(lsm.diskLevels) - 1
+	for i, dl := range lsm.diskLevels[:bi] {
+		if runs := dl.overlapping(lo, hi); len(runs) > 0 {
+			t.Fatalf("level %v still has %v runs in [%v, %v]", i+1, len(runs), lo, hi)
+		}
+	}
+	for _, r := range lsm.diskLevels[bi].overlapping(lo, hi) {
+		if r.GetTombstones() > 0 {
+			t.Fatalf("bottom run %v has %v tombstones", r.fileNum, r.GetTombstones())
+		}
+	}
+}
+
+func TestCompactAll(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    CompactionPolicy
+		partition uint64
+	}{
+		{name: "tiering", policy: TieringPolicy{}},
+		{name: "leveling-partitioned", policy: LevelingPolicy{}, partition: 64},
+		{name: "lazy-leveling", policy: LazyLevelingPolicy{}},
+	}
+	for _, tt := range tests {
+		o := DefaultOptions()
+		o.Dir = t.TempDir()
+		o.EltsPerRun = 32
+		o.NumRuns = 4
+		o.PageSize = 16
+		o.DiskRunsPerLevel = 4
+		o.CompactionPolicy = tt.policy
+		o.PartitionSize = tt.partition
+		lsm := NewLSMWithOptions(o)
+		const keySpace = 2000
+		r := rand.New(rand.NewSource(1))
+		var m lsmModel
+		for i := 0; i < 8000; i++ {
+			op := lsmOp{key: r.Intn(keySpace), value: r.Intn(1 << 30)}
+			if r.Intn(3) == 0 {
+				op.value = TOMBSTONE
+			}
+			m.write(lsm, op)
+		}
+
+		var calls []CompactionProgress
+		if err := <-lsm.CompactAll(context.Background(), func(p CompactionProgress) {
+			calls = append(calls, p)
+		}); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		checkCompacted(t, lsm, math.MinInt, math.MaxInt)
+		checkLSM(t, lsm, m.state(len(m.ops)), keySpace, r)
+
+		// 每层回调一次，最后一次合并到最下面一层
+		if len(calls) == 0 {
+			t.Fatalf("%v: no progress", tt.name)
+		}
+		for i, p := range calls {
+			if p.Level != i+1 || (i > 0 && p.KeysWritten < calls[i-1].KeysWritten) {
+				t.Fatalf("%v: progress %v", tt.name, calls)
+			}
+		}
+		if last := calls[len(calls)-1]; last.Level+1 < last.NumLevels || last.KeysWritten == 0 {
+			t.Fatalf("%v: last progress %+v", tt.name, last)
+		}
+		lsm.Close()
+	}
+}
+
+// 批量删除后马上手动合并，已经交给后台合并还没写入第1层的内存run中的删除标记也要丢弃
+func TestCompactAllAfterBulkDelete(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 64
+	o.NumRuns = 4
+	o.PageSize = 16
+	o.DiskRunsPerLevel = 4
+	lsm := NewLSMWithOptions(o)
+	defer lsm.Close()
+	for i := 0; i < 5000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	for i := 0; i < 5000; i++ {
+		lsm.DeleteKey(i)
+	}
+	waitCompactions(lsm)
+
+	// 暂停调度，让最后一次内存run的合并排着队
+	lsm.sched.pause()
+	for i, active := 0, lsm.activeRun; ; i++ {
+		lsm.DeleteKey(i)
+		if lsm.activeRun < active {
+			break
+		}
+		active = lsm.activeRun
+	}
+	done := lsm.CompactAll(context.Background(), nil)
+	time.Sleep(50 * time.Millisecond)
+	lsm.sched.resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitCompactions(lsm)
+
+	lsm.diskMu.RLock()
+	var tombstones uint64
+	for _, dl := range lsm.diskLevels {
+		tombstones += dl.GetTombstonesNum()
+	}
+	lsm.diskMu.RUnlock()
+	if tombstones > 0 {
+		t.Fatalf("%v tombstones left on disk", tombstones)
+	}
+	for i := 0; i < 5000; i++ {
+		if _, ok := lsm.Lookup(i); ok {
+			t.Fatalf("deleted key %v found", i)
+		}
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 32
+	o.NumRuns = 4
+	o.PageSize = 16
+	o.DiskRunsPerLevel = 4
+	lsm := NewLSMWithOptions(o)
+	defer lsm.Close()
+	const keySpace = 19000
+	r := rand.New(rand.NewSource(2))
+	var m lsmModel
+	// 每次合并的内存run(128个kv)只覆盖一段key，各段之间有空隙，上面几层的run两两不重叠
+	for i := 0; i < 12000; i++ {
+		op := lsmOp{key: i/128*200 + r.Intn(128), value: i}
+		if r.Intn(4) == 0 {
+			op.value = TOMBSTONE
+		}
+		m.write(lsm, op)
+	}
+	waitCompactions(lsm)
+	lsm.diskMu.RLock()
+	before := len(lsm.diskLevels[0].runs)
+	lsm.diskMu.RUnlock()
+
+	if err := <-lsm.CompactRange(context.Background(), 3900, 4100, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkCompacted(t, lsm, 3900, 4099)
+	checkLSM(t, lsm, m.state(len(m.ops)), keySpace, r)
+	lsm.diskMu.RLock()
+	after := len(lsm.diskLevels[0].runs)
+	lsm.diskMu.RUnlock()
+	if before > 1 && after == 0 {
+		t.Fatalf("compacting a small range moved all %v runs of level 1", before)
+	}
+
+	if err := <-lsm.CompactRange(context.Background(), 10, 10, nil); err != nil {
+		t.Fatalf("empty range: %v", err)
+	}
+}
+
+func TestCompactCancel(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 32
+	o.NumRuns = 4
+	o.PageSize = 16
+	o.DiskRunsPerLevel = 2
+	lsm := NewLSMWithOptions(o)
+	defer lsm.Close()
+	for i := 0; i < 6000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	waitCompactions(lsm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	if err := <-lsm.CompactAll(ctx, func(CompactionProgress) { called = true }); err != context.Canceled || called {
+		t.Fatalf("canceled before start: err %v, progress called %v", err, called)
+	}
+
+	// 合并完第1层后取消，已完成的部分保留
+	lsm.diskMu.RLock()
+	numLevels := len(lsm.diskLevels)
+	lsm.diskMu.RUnlock()
+	if numLevels < 3 {
+		t.Fatalf("only %v levels", numLevels)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	var calls []CompactionProgress
+	err := <-lsm.CompactAll(ctx, func(p CompactionProgress) {
+		calls = append(calls, p)
+		cancel()
+	})
+	if err != context.Canceled || len(calls) != 1 || calls[0].Level != 1 {
+		t.Fatalf("err %v, progress %v", err, calls)
+	}
+	lsm.diskMu.RLock()
+	level1 := len(lsm.diskLevels[0].runs)
+	lsm.diskMu.RUnlock()
+	if level1 != 0 {
+		t.Fatalf("level 1 still has %v runs", level1)
+	}
+	for i := 0; i < 6000-128; i++ {
+		if v, ok := lsm.Lookup(i); !ok || v != i {
+			t.Fatalf("lookup %v = %v, %v", i, v, ok)
+		}
+	}
+}
+
+// 手动合并写新文件时不持有diskMu，查找不用等合并结束
+func TestCompactAllDoesNotBlockLookups(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.RateLimiter = NewRateLimiter(0)
+	lsm := NewLSMWithOptions(o)
+	defer lsm.Close()
+	const n = 48000 // 3个内存run的合并，都在第1层
+	for i := 0; i < n; i++ {
+		lsm.InsertKey(i, i)
+	}
+	waitCompactions(lsm)
+
+	// 改写第1层的48000个kv约768KB，限速后要1秒以上
+	o.RateLimiter.SetRate(512 << 10)
+	done := lsm.CompactAll(context.Background(), nil)
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 32000; i += 32 {
+		if v, ok := lsm.Lookup(i); !ok || v != i {
+			t.Fatalf("lookup %v = %v, %v", i, v, ok)
+		}
+	}
+	elapsed := time.Since(start)
+	select {
+	case err := <-done:
+		t.Fatalf("compaction finished before lookups (err %v), lookups took %v", err, elapsed)
+	default:
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("lookups took %v during compaction", elapsed)
+	}
+	o.RateLimiter.SetRate(0)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
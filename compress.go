@@ -0,0 +1,158 @@
+package slsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// 内置压缩算法的ID，写入run文件，打开时据此找到解压算法
+const (
+	NoCompression    uint8 = 0
+	ZlibCompression  uint8 = 1
+	FlateCompression uint8 = 2
+)
+
+// Compressor 页压缩算法
+type Compressor interface {
+	// ID 唯一标识，0保留给不压缩
+	ID() uint8
+	// Compress 压缩src，结果追加到dst后返回
+	Compress(dst, src []byte) []byte
+	// Decompress 解压src，结果追加到dst后返回
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[uint8]Compressor{}
+)
+
+// RegisterCompressor 注册压缩算法，重新打开run时按ID查找。
+// ID不能重复注册，否则已有的文件会用另一个算法解压
+func RegisterCompressor(c Compressor) {
+	if c.ID() == NoCompression {
+		panic("slsm: compressor id 0 is reserved")
+	}
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if _, ok := compressors[c.ID()]; ok {
+		panic(fmt.Errorf("slsm: compressor id %v already registered", c.ID()))
+	}
+	compressors[c.ID()] = c
+}
+
+func getCompressor(id uint8) Compressor {
+	if id == NoCompression {
+		return nil
+	}
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[id]
+	if !ok {
+		panic(fmt.Errorf("slsm: unknown compressor %v", id))
+	}
+	return c
+}
+
+// checkCompressor 确保c已经注册，没有注册时注册它，重新打开时才能找到。
+// ID被另一种压缩算法占用时panic；同一种算法只是压缩级别不同时解压方法相同，可以共用ID
+func checkCompressor(c Compressor) {
+	if c.ID() == NoCompression {
+		panic("slsm: compressor id 0 is reserved")
+	}
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	r, ok := compressors[c.ID()]
+	if !ok {
+		compressors[c.ID()] = c
+		return
+	}
+	if reflect.TypeOf(r) != reflect.TypeOf(c) {
+		panic(fmt.Errorf("slsm: compressor id %v is registered by %T, not %T", c.ID(), r, c))
+	}
+}
+
+func init() {
+	RegisterCompressor(NewZlibCompressor(zlib.DefaultCompression))
+	RegisterCompressor(NewFlateCompressor(flate.DefaultCompression))
+}
+
+// ZlibCompressor zlib压缩
+type ZlibCompressor struct {
+	level int
+}
+
+// NewZlibCompressor new
+// @param level - 压缩级别，同compress/zlib
+func NewZlibCompressor(level int) *ZlibCompressor {
+	return &ZlibCompressor{level: level}
+}
+
+func (c *ZlibCompressor) ID() uint8 {
+	return ZlibCompression
+}
+
+func (c *ZlibCompressor) Compress(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w, err := zlib.NewWriterLevel(buf, c.level)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (c *ZlibCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllTo(dst, r)
+}
+
+// FlateCompressor DEFLATE压缩(不带zlib头和校验)
+type FlateCompressor struct {
+	level int
+}
+
+// NewFlateCompressor new
+// @param level - 压缩级别，同compress/flate
+func NewFlateCompressor(level int) *FlateCompressor {
+	return &FlateCompressor{level: level}
+}
+
+func (c *FlateCompressor) ID() uint8 {
+	return FlateCompression
+}
+
+func (c *FlateCompressor) Compress(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, c.level)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (c *FlateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readAllTo(dst, r)
+}
+
+func readAllTo(dst []byte, r io.Reader) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
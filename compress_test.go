@@ -0,0 +1,63 @@
+package slsm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testCompressor 测试用的压缩算法，没有注册过
+type testCompressor struct{ FlateCompressor }
+
+func (*testCompressor) ID() uint8 {
+	return 201
+}
+
+// conflictCompressor 占用内置的ID
+type conflictCompressor struct{ FlateCompressor }
+
+func (*conflictCompressor) ID() uint8 {
+	return ZlibCompression
+}
+
+func TestRegisterCompressorRejectsDuplicate(t *testing.T) {
+	expectPanic(t, "builtin id", func() { RegisterCompressor(NewZlibCompressor(1)) })
+	expectPanic(t, "reserved id", func() { RegisterCompressor(&conflictCompressor{}) })
+	if _, ok := getCompressor(ZlibCompression).(*ZlibCompressor); !ok {
+		t.Fatalf("zlib replaced by %T", getCompressor(ZlibCompression))
+	}
+
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.LevelCompression = []Compressor{&conflictCompressor{}}
+	expectPanic(t, "options compressor", func() { NewLSMWithOptions(o) })
+}
+
+func TestCustomCompressorReopen(t *testing.T) {
+	c := &testCompressor{FlateCompressor{level: 1}}
+	src := bytes.Repeat([]byte("slsm"), 100)
+	data, err := c.Decompress(nil, c.Compress(nil, src))
+	if err != nil || !bytes.Equal(data, src) {
+		t.Fatalf("round trip %v", err)
+	}
+
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 64
+	o.NumRuns = 2
+	o.PageSize = 16
+	o.LevelCompression = []Compressor{c, NewFlateCompressor(9)} // 不同的压缩级别共用内置ID
+	lsm := NewLSMWithOptions(o)
+	for i := 0; i < 1000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	lsm.Close()
+
+	lsm = NewLSMWithOptions(o)
+	defer lsm.Close()
+	// 内存run关闭时不落盘，只检查已经合并到磁盘的key
+	for i := 0; i < 512; i++ {
+		if v, ok := lsm.Lookup(i); !ok || v != i {
+			t.Fatalf("lookup %v = %v, %v", i, v, ok)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package slsm
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+const (
+	cuckooBucketSize = 4
+	cuckooMaxKicks   = 500
+	cuckooLoadFactor = 0.95
+)
+
+// CuckooFilter 布谷鸟过滤器(Fan et al., 2014)，每个桶4个指纹，支持删除。
+// 指纹位数按误判率选择，误判率约为 2·4·装载率/2^位数。
+// 同一个key加入几次就占几个槽，删除时也要删除相同次数
+type CuckooFilter struct {
+	filterHash
+	slots      []uint64 // 所有槽的指纹紧密排列，每个fpBits位，0表示空
+	numBuckets uint64
+	fpBits     uint8
+	count      uint64
+	full       bool // 插入失败过，之后MayContain总是返回true
+	kick       uint64
+}
+
+// NewCuckooFilter new
+// @param n - 预估元素个数
+// @param p - 误判率
+func NewCuckooFilter(n uint64, p float64) *CuckooFilter {
+	numBuckets := uint64(math.Ceil(float64(n) / cuckooBucketSize / cuckooLoadFactor))
+	if numBuckets == 0 {
+		numBuckets = 1
+	}
+	fpBits := math.Ceil(math.Log2(2 * cuckooBucketSize * cuckooLoadFactor / p))
+	fpBits = math.Max(4, math.Min(32, fpBits))
+	f := &CuckooFilter{numBuckets: numBuckets, fpBits: uint8(fpBits)}
+	f.slots = make([]uint64, (numBuckets*cuckooBucketSize*uint64(f.fpBits)+63)/64)
+	return f
+}
+
+// indexes 返回key的指纹和两个候选桶
+func (f *CuckooFilter) indexes(key []byte) (uint64, uint64, uint64) {
+	h1, h2 := f.sum(key)
+	fp := h2%(1<<f.fpBits-1) + 1
+	i1, _ := bits.Mul64(h1, f.numBuckets)
+	return fp, i1, f.altIndex(i1, fp)
+}
+
+// altIndex 另一个候选桶: (hash(fp) - i) mod 桶个数，对两个桶互为逆运算，桶个数不需要是2的幂
+func (f *CuckooFilter) altIndex(i uint64, fp uint64) uint64 {
+	h := fmix64(fp) % f.numBuckets
+	return (h + f.numBuckets - i) % f.numBuckets
+}
+
+// get 返回第s个槽的指纹
+func (f *CuckooFilter) get(s uint64) uint64 {
+	pos := s * uint64(f.fpBits)
+	w, off := pos/64, pos%64
+	v := f.slots[w] >> off
+	if off+uint64(f.fpBits) > 64 {
+		v |= f.slots[w+1] << (64 - off)
+	}
+	return v & (1<<f.fpBits - 1)
+}
+
+// set 设置第s个槽的指纹
+func (f *CuckooFilter) set(s uint64, fp uint64) {
+	pos := s * uint64(f.fpBits)
+	w, off := pos/64, pos%64
+	mask := uint64(1)<<f.fpBits - 1
+	f.slots[w] = f.slots[w]&^(mask<<off) | fp<<off
+	if off+uint64(f.fpBits) > 64 {
+		shift := 64 - off
+		f.slots[w+1] = f.slots[w+1]&^(mask>>shift) | fp>>shift
+	}
+}
+
+func (f *CuckooFilter) insertInto(i uint64, fp uint64) bool {
+	for s := i * cuckooBucketSize; s < (i+1)*cuckooBucketSize; s++ {
+		if f.get(s) == 0 {
+			f.set(s, fp)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *CuckooFilter) Add(key []byte) {
+	if f.full {
+		return
+	}
+	fp, i1, i2 := f.indexes(key)
+	if f.insertInto(i1, fp) || f.insertInto(i2, fp) {
+		f.count++
+		return
+	}
+	// 随机踢出一个指纹到它的另一个桶
+	i := i1
+	for n := 0; n < cuckooMaxKicks; n++ {
+		f.kick = fmix64(f.kick + 1)
+		s := i*cuckooBucketSize + f.kick%cuckooBucketSize
+		old := f.get(s)
+		f.set(s, fp)
+		fp = old
+		i = f.altIndex(i, fp)
+		if f.insertInto(i, fp) {
+			f.count++
+			return
+		}
+	}
+	f.full = true
+}
+
+// find 返回key的指纹所在的槽
+func (f *CuckooFilter) find(key []byte) (uint64, bool) {
+	fp, i1, i2 := f.indexes(key)
+	for _, i := range [2]uint64{i1, i2} {
+		for s := i * cuckooBucketSize; s < (i+1)*cuckooBucketSize; s++ {
+			if f.get(s) == fp {
+				return s, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (f *CuckooFilter) MayContain(key []byte) bool {
+	if f.full {
+		return true
+	}
+	_, ok := f.find(key)
+	return ok
+}
+
+// Delete 删除一个加入过的key。删除没有加入过的key可能把其它key删掉
+func (f *CuckooFilter) Delete(key []byte) bool {
+	if f.full {
+		return false
+	}
+	s, ok := f.find(key)
+	if ok {
+		f.set(s, 0)
+		f.count--
+	}
+	return ok
+}
+
+// Count 返回当前元素个数
+func (f *CuckooFilter) Count() uint64 {
+	return f.count
+}
+
+// MarshalBinary 编码: full(1字节) | 指纹位数(1字节) | 元素个数(uvarint) | 桶个数(uvarint) | 槽(小端)
+func (f *CuckooFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 2+2*binary.MaxVarintLen64+len(f.slots)*8)
+	var full byte
+	if f.full {
+		full = 1
+	}
+	data = append(data, full, f.fpBits)
+	data = appendUvarint(data, f.count)
+	data = appendUvarint(data, f.numBuckets)
+	var w [8]byte
+	for _, v := range f.slots {
+		binary.LittleEndian.PutUint64(w[:], v)
+		data = append(data, w[:]...)
+	}
+	return data, nil
+}
+
+func (f *CuckooFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errCorruptFilter
+	}
+	full := data[0] == 1
+	fpBits := data[1]
+	if fpBits < 4 || fpBits > 32 {
+		return errCorruptFilter
+	}
+	data = data[2:]
+	count, k := binary.Uvarint(data)
+	if k <= 0 {
+		return errCorruptFilter
+	}
+	data = data[k:]
+	numBuckets, k := binary.Uvarint(data)
+	if k <= 0 || numBuckets == 0 {
+		return errCorruptFilter
+	}
+	data = data[k:]
+	numSlots := (numBuckets*cuckooBucketSize*uint64(fpBits) + 63) / 64
+	if uint64(len(data)) != numSlots*8 {
+		return errCorruptFilter
+	}
+	f.slots = make([]uint64, numSlots)
+	for i := range f.slots {
+		f.slots[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	f.numBuckets = numBuckets
+	f.fpBits = fpBits
+	f.count = count
+	f.full = full
+	return nil
+}
@@ -2,10 +2,8 @@ package slsm
 
 import (
 	"math"
-)
-
-const (
-	None = math.MinInt64
+	"sort"
+	"sync/atomic"
 )
 
 type KVIntPair struct {
@@ -20,7 +18,7 @@ func NewKVIntPair(kv KVPair, index int) KVIntPair {
 	}
 }
 
-// StaticHeap is a min-heap
+// StaticHeap is a min-heap. 合并已经改用败者树(loserTree)，保留供外部使用
 type StaticHeap struct {
 	arr []KVIntPair
 }
@@ -79,134 +77,364 @@ func (h *StaticHeap) heapify(i int) {
 }
 
 type DiskLevel struct {
-	level     int    // 第几层（从0开始)
+	dir       string
+	level     int    // 第几层（从1开始)
 	numRuns   int    // number of runs in a level
 	runSize   uint64 // number of elts in a run
 	mergeSize int    // 一次合并run的个数
 	pageSize  uint32
-	bffp      float64
+	bffp      uint64 // 新run的过滤器误判率(math.Float64bits)，后台合并时可能被重新分配
+
+	format RunFormat // 本层run文件的格式
+
+	cache   *BlockCache // 页缓存，nil表示不缓存
+	cacheID uint64
+
+	lazyFilter bool // 恢复的run第一次查找时才加载过滤器
+
+	limiter    *RateLimiter // 合并写文件的限速器，nil表示不限速
+	limitReads bool         // 合并读run也限速
+
+	compactPointer int // 分区的分级层上次合并到下一层的最大key，下次从它之后挑选文件
 
-	runs      []*DiskRun
-	activeRun int
+	runs []*DiskRun // 按从旧到新排列
 }
 
+// @param dir - 数据目录
 // @param pageSize -
 // @param level - 第几层
 // @param runSize - 每个run得大小
 // @param numRuns - run得个数
 // @param mergeSize - 需要merge得run个数
-func NewDiskLevel(pageSize uint32, level int, runSize uint64, numRuns int, mergeSize int, bffp float64) *DiskLevel {
-	dl := &DiskLevel{
+// @param format - run文件的格式
+func NewDiskLevel(dir string, pageSize uint32, level int, runSize uint64, numRuns int, mergeSize int, bffp float64, format RunFormat) *DiskLevel {
+	return &DiskLevel{
+		dir:       dir,
 		level:     level,
 		numRuns:   numRuns,
 		runSize:   runSize,
 		mergeSize: mergeSize,
 		pageSize:  pageSize,
+		bffp:      math.Float64bits(bffp),
+		format:    format,
 		runs:      make([]*DiskRun, 0, numRuns),
 	}
+}
+
+// writeRun 把有序的kv写入文件编号为fileNum的新run，不加入本层
+func (dl *DiskLevel) writeRun(fileNum uint64, kvs []KVPair) *DiskRun {
+	w := dl.newWriter(fileNum, uint64(len(kvs)))
+	for _, kv := range kvs {
+		w.Add(kv)
+	}
+	return w.Finish()
+}
+
+// newWriter 创建文件编号为fileNum的新run，按本层的格式和误判率写，写入受限速器限制
+// @param capacity - 预估的kv个数，用于过滤器
+func (dl *DiskLevel) newWriter(fileNum uint64, capacity uint64) *runWriter {
+	w := newRunWriter(dl.dir, fileNum, capacity, dl.pageSize, dl.falsePositiveRate(), dl.format)
+	w.limiter = dl.limiter
+	return w
+}
 
-	for i := 0; i < int(numRuns); i++ {
-		run := NewDiskRun(runSize, pageSize, level, i, bffp)
-		dl.runs = append(dl.runs, run)
-	}
-	return dl
-}
-
-// AddRunByArray新增加一个run
-func (dl *DiskLevel) AddRunByArray(runToAdd []KVPair) {
-	if dl.activeRun >= dl.numRuns {
-		panic("")
-	}
-	runLen := len(runToAdd)
-	if uint64(runLen) != dl.runSize {
-		panic("")
-	}
-	dl.runs[dl.activeRun].WiteData(runToAdd, 0)
-	dl.runs[dl.activeRun].ConstructIndex()
-	dl.activeRun++
-}
-
-// AddRuns 合并runList构造一个run
-func (dl *DiskLevel) AddRuns(runList []*DiskRun, runLen uint64, lastLevel bool) {
-	k := len(runList)
-	var h = NewStaticHeap(k)
-	var S = dl.runs[dl.activeRun]
-	for r := 0; r < k; r++ {
-		kvp := runList[r].data[0]
-		h.Push(NewKVIntPair(kvp, r))
-	}
-	j := -1
-	lastKey := None
-	lastK := None
-	Heads := make([]int, k)
-	for h.Len() > 0 {
-		v := h.Pop()
-		if v.Key == lastKey { // ?? 也可以在堆中处理相等的情况，则只要相等就是老的 ??
-			// when several runs from level k contain the same key,
-			// the value that remains tied to that key on level k+1 must be the most recently writen
-			if lastK < v.k {
-				S.data[j] = v.KVPair
-				lastK = v.k
+// mergeIterator 合并时读run的迭代器，开启RateLimitReads时读也受限速器限制
+func (dl *DiskLevel) mergeIterator(r *DiskRun) *RunIterator {
+	if dl.limitReads {
+		return r.newLimitedIterator(dl.limiter)
+	}
+	return r.NewIterator()
+}
+
+func (dl *DiskLevel) falsePositiveRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&dl.bffp))
+}
+
+func (dl *DiskLevel) setFalsePositiveRate(p float64) {
+	atomic.StoreUint64(&dl.bffp, math.Float64bits(p))
+}
+
+// kvIterator 按key从小到大遍历kv
+type kvIterator interface {
+	Valid() bool
+	Value() KVPair
+	Next()
+}
+
+// sliceIterator 遍历有序的kv数组
+type sliceIterator struct {
+	kvs []KVPair
+	i   int
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.i < len(it.kvs)
+}
+
+func (it *sliceIterator) Value() KVPair {
+	return it.kvs[it.i]
+}
+
+func (it *sliceIterator) Next() {
+	it.i++
+}
+
+// writeRuns 合并runList写入文件编号为fileNum的新run，不加入本层。
+// runList的key范围两两不重叠时(例如顺序写入的key)按key顺序直接拼接，不经过多路归并。
+// lastLevel表示合并结果是最下面一层唯一的数据，不再有更旧的版本，可以丢弃删除标记
+func (dl *DiskLevel) writeRuns(fileNum uint64, runList []*DiskRun, lastLevel bool) *DiskRun {
+	var capacity uint64
+	for _, r := range runList {
+		capacity += r.GetCapacity()
+	}
+	var run *DiskRun
+	if sorted := sortRuns(runList); runsDisjoint(sorted) {
+		w := dl.newWriter(fileNum, capacity)
+		for _, r := range sorted {
+			for it := dl.mergeIterator(r); it.Valid(); it.Next() {
+				if !lastLevel || it.Value().Value != TOMBSTONE {
+					w.Add(it.Value())
+				}
 			}
+		}
+		run = w.Finish()
+	} else {
+		its := make([]kvIterator, 0, len(runList))
+		for _, r := range runList {
+			its = append(its, dl.mergeIterator(r))
+		}
+		run = dl.writeMerged(fileNum, its, capacity, lastLevel)
+	}
+	return run
+}
+
+// partitionReplaced 分区的分级层用：返回与ranges重叠要改写的文件和保留的文件，都按从旧到新排列。
+// 层内已经有重叠时改写整层
+func (dl *DiskLevel) partitionReplaced(ranges [][2]int) (replaced, kept []*DiskRun) {
+	disjoint := dl.disjoint()
+	for _, r := range dl.runs {
+		if !disjoint || r.overlaps(ranges) {
+			replaced = append(replaced, r)
 		} else {
-			j = j + 1
-			S.data[j] = v.KVPair
-			lastKey = v.Key
-			lastK = v.k
+			kept = append(kept, r)
 		}
+	}
+	return replaced, kept
+}
+
+// partitionBounds 返回保留文件的最小key，新文件不能跨过保留的文件，否则层内又会重叠
+func partitionBounds(kept []*DiskRun) []int {
+	bounds := make([]int, 0, len(kept))
+	for _, r := range kept {
+		bounds = append(bounds, r.minKey)
+	}
+	sort.Ints(bounds)
+	return bounds
+}
 
-		Heads[v.k]++
-		if Heads[v.k] < len(runList[v.k].data) {
-			kvp := runList[v.k].data[Heads[v.k]]
-			h.Push(NewKVIntPair(kvp, v.k))
+// writePartitions 多路归并its，每partitionSize个kv或遇到bounds中的key时切换到新文件，不加入本层
+func (dl *DiskLevel) writePartitions(newFileNum func() uint64, its []kvIterator, capacity uint64,
+	partitionSize uint64, bounds []int, dropTombstones bool) []*DiskRun {
+	if capacity > partitionSize {
+		capacity = partitionSize
+	}
+	var added []*DiskRun
+	var w *runWriter
+	var lastKey int
+	finish := func() {
+		if run := w.Finish(); run != nil {
+			added = append(added, run)
 		}
+		w = nil
 	}
-	S.SetCapacity(uint64(j + 1))
-	S.ConstructIndex()
-	if j+1 > 0 {
-		dl.activeRun++
+	mergeIterators(its, func(kv KVPair) {
+		if dropTombstones && kv.Value == TOMBSTONE {
+			return
+		}
+		if w != nil {
+			i := sort.SearchInts(bounds, lastKey+1)
+			if w.count >= partitionSize || (i < len(bounds) && bounds[i] <= kv.Key) {
+				finish()
+			}
+		}
+		if w == nil {
+			w = dl.newWriter(newFileNum(), capacity)
+		}
+		w.Add(kv)
+		lastKey = kv.Key
+	})
+	if w != nil {
+		finish()
+	}
+	return added
+}
+
+// disjoint 本层的run是否两两不重叠
+func (dl *DiskLevel) disjoint() bool {
+	return runsDisjoint(dl.sortedRuns())
+}
+
+// sortedRuns 返回按最小key排序的run
+func (dl *DiskLevel) sortedRuns() []*DiskRun {
+	return sortRuns(dl.runs)
+}
+
+// sortRuns 返回按最小key排序的run，不修改runs
+func sortRuns(runs []*DiskRun) []*DiskRun {
+	sorted := append([]*DiskRun{}, runs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].minKey < sorted[j].minKey
+	})
+	return sorted
+}
+
+// runsDisjoint 按最小key排好序的run是否两两不重叠
+func runsDisjoint(sorted []*DiskRun) bool {
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].maxKey >= sorted[i].minKey {
+			return false
+		}
+	}
+	return true
+}
+
+// overlapping 返回与[lo, hi]重叠的run，按从旧到新排列。
+// 选中的run的key范围并集内的其他run也一起选中，剩下的run和选中的run不重叠，移走选中的run不会改变新旧关系
+func (dl *DiskLevel) overlapping(lo, hi int) []*DiskRun {
+	selected := make([]bool, len(dl.runs))
+	for changed := true; changed; {
+		changed = false
+		for i, r := range dl.runs {
+			if selected[i] || r.GetCapacity() == 0 || r.minKey > hi || r.maxKey < lo {
+				continue
+			}
+			selected[i] = true
+			changed = true
+			if r.minKey < lo {
+				lo = r.minKey
+			}
+			if r.maxKey > hi {
+				hi = r.maxKey
+			}
+		}
+	}
+	var runs []*DiskRun
+	for i, r := range dl.runs {
+		if selected[i] {
+			runs = append(runs, r)
+		}
+	}
+	return runs
+}
+
+// PickFilesToMerge 分区的分级层用：从上次合并结束的位置开始按key顺序挑选文件，直到kv个数不少于n。
+// 不移动compactPointer，确定合并这些文件后再设置
+func (dl *DiskLevel) PickFilesToMerge(n uint64) []*DiskRun {
+	runs := dl.sortedRuns()
+	start := sort.Search(len(runs), func(i int) bool {
+		return runs[i].minKey > dl.compactPointer
+	})
+	if start == len(runs) {
+		start = 0
+	}
+	var picked []*DiskRun
+	var total uint64
+	for i := 0; i < len(runs) && (len(picked) == 0 || total < n); i++ {
+		r := runs[(start+i)%len(runs)]
+		picked = append(picked, r)
+		total += r.GetCapacity()
+	}
+	return picked
+}
+
+// writeMerged 多路归并its写入文件编号为fileNum的新run
+// @param capacity - 预估的kv个数，用于过滤器
+// @param dropTombstones - 丢弃删除标记
+func (dl *DiskLevel) writeMerged(fileNum uint64, its []kvIterator, capacity uint64, dropTombstones bool) *DiskRun {
+	var S = dl.newWriter(fileNum, capacity)
+	mergeIterators(its, func(kv KVPair) {
+		if !dropTombstones || kv.Value != TOMBSTONE {
+			S.Add(kv)
+		}
+	})
+	return S.Finish()
+}
+
+// mergeIterators 多路归并its，按key从小到大输出，相同的key只保留下标最大(最新)的迭代器中的值
+func mergeIterators(its []kvIterator, emit func(KVPair)) {
+	for t := newLoserTree(its); t.Valid(); t.Next() {
+		emit(t.Value())
+	}
+}
+
+// restoreRun 恢复manifest中记录的run
+func (dl *DiskLevel) restoreRun(meta runMeta) {
+	run := OpenDiskRun(dl.dir, meta.fileNum, dl.lazyFilter)
+	dl.appendRun(run)
+}
+
+func (dl *DiskLevel) appendRun(run *DiskRun) {
+	run.cache, run.cacheID = dl.cache, dl.cacheID
+	dl.runs = append(dl.runs, run)
+}
+
+// SetBlockCache 设置本层run使用的页缓存
+func (dl *DiskLevel) SetBlockCache(cache *BlockCache, id uint64) {
+	dl.cache, dl.cacheID = cache, id
+	for _, run := range dl.runs {
+		run.cache, run.cacheID = cache, id
 	}
 }
 
 func (dl *DiskLevel) LevelFull() bool {
-	return dl.activeRun == dl.numRuns
+	return len(dl.runs) >= dl.numRuns
 }
 
 func (dl *DiskLevel) LevelEmpty() bool {
-	return dl.activeRun == 0
+	return len(dl.runs) == 0
+}
+
+// capacity 本层最多容纳的kv个数
+func (dl *DiskLevel) capacity() uint64 {
+	return dl.runSize * uint64(dl.numRuns)
 }
 
+// GetRunsToMerge 返回分层时要合并到下一层的最旧的mergeSize个run
 func (dl *DiskLevel) GetRunsToMerge() []*DiskRun {
-	toMerge := make([]*DiskRun, 0, dl.mergeSize)
-	for i := 0; i < dl.mergeSize; i++ {
+	n := dl.mergeSize
+	if n > len(dl.runs) {
+		n = len(dl.runs)
+	}
+	toMerge := make([]*DiskRun, 0, n)
+	for i := 0; i < n; i++ {
 		toMerge = append(toMerge, dl.runs[i])
 	}
 	return toMerge
 }
 
-func (dl *DiskLevel) FreeMergedRuns() {
-	copy(dl.runs, dl.runs[dl.mergeSize:])
-	dl.runs = dl.runs[:len(dl.runs)-dl.mergeSize]
-	dl.activeRun -= dl.mergeSize
-	for i := 0; i < dl.activeRun; i++ {
-		dl.runs[i].ChangeRunID(i)
+// FreeMergedRuns 把已合并的run移出本层并返回，文件要等manifest更新后再删除。
+// 剩下的run只是在层中前移，文件不需要改名
+func (dl *DiskLevel) FreeMergedRuns(merged []*DiskRun) []*DiskRun {
+	isMerged := make(map[*DiskRun]bool, len(merged))
+	for _, r := range merged {
+		isMerged[r] = true
 	}
-
-	for i := dl.activeRun; i < dl.numRuns; i++ {
-		newRun := NewDiskRun(dl.runSize, dl.pageSize, dl.level, i, dl.bffp)
-		dl.runs = append(dl.runs, newRun)
+	n := 0
+	for _, r := range dl.runs {
+		if !isMerged[r] {
+			dl.runs[n] = r
+			n++
+		}
 	}
+	dl.runs = dl.runs[:n]
+	return merged
 }
 
 func (dl *DiskLevel) Lookup(key int) (int, bool) {
-	maxRunToSearch := dl.activeRun - 1
-	if dl.LevelFull() {
-		maxRunToSearch = dl.numRuns - 1
-	}
-	for i := maxRunToSearch; i >= 0; i-- {
+	for i := len(dl.runs) - 1; i >= 0; i-- {
 		if key < dl.runs[i].minKey ||
 			key > dl.runs[i].maxKey ||
-			!dl.runs[i].bf.MayContain(encodeInt(key)) {
+			!dl.runs[i].MayContain(key) {
 			continue
 		}
 		lookupRes, found := dl.runs[i].Lookup(key)
@@ -219,8 +447,24 @@ func (dl *DiskLevel) Lookup(key int) (int, bool) {
 
 func (dl *DiskLevel) GetElementsNum() uint64 {
 	var total uint64
-	for i := 0; i < dl.activeRun; i++ {
+	for i := 0; i < len(dl.runs); i++ {
 		total += dl.runs[i].GetCapacity()
 	}
 	return total
 }
+
+// GetTombstonesNum 本层删除标记的个数
+func (dl *DiskLevel) GetTombstonesNum() uint64 {
+	var total uint64
+	for _, r := range dl.runs {
+		total += r.GetTombstones()
+	}
+	return total
+}
+
+// Close 关闭本层所有run文件
+func (dl *DiskLevel) Close() {
+	for _, r := range dl.runs {
+		r.Close()
+	}
+}
@@ -1,99 +1,257 @@
 package slsm
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"os"
-	"reflect"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
 
+// run文件格式: 页0 | 页1 | ... | 过滤器 | 范围过滤器 | 文件尾 | 文件尾长度(4字节) | magic(4字节)
+// 文件尾: 压缩算法ID(1字节) | 页编码(1字节) | kv个数 | 删除标记个数 | 每页kv个数 | 页数 | 每页的字节数... |
+// 最小key | 最大key | 每页第一个key(fence pointer) | 过滤器字节数 | 范围过滤器字节数(0表示没有)
+// 定长编码且不压缩时每页就是KVPair数组，整个数据区可以直接映射成[]KVPair。
+// 打开时直接读出fence pointer和过滤器，不需要扫描数据
+const (
+	runMagic       uint32 = 0x736c736d
+	runTrailerSize        = 8
+)
+
+var errCorruptRun = errors.New("slsm: corrupt run file")
+
 type DiskRun struct {
-	dataref []byte   // 原始数据
-	data    []KVPair // 原始数据转成KVPAIR
+	dataref []byte   // mmap的文件内容
+	data    []KVPair // 不压缩时文件开头就是KVPair数组
 
-	runID    int
-	level    int
+	fileNum  uint64 // 文件编号，单调递增且创建后不再改变；所在层和位置记录在manifest中
 	filename string
 
 	fd            *os.File
 	capacity      uint64
 	pageSize      uint64
-	fencePointers []int
-	iMaxFP        uint64
-	bf            *BloomFilter
-	bffp          float64
+	compressor    Compressor // nil表示不压缩
+	encoding      PageEncoding
+	cache         *BlockCache // 解码后的页缓存，nil表示不缓存
+	cacheID       uint64
+	pageOffsets   []uint64 // 每页在文件中的起始偏移，最后多一个数据结尾偏移
+	fencePointers []int    // 每页第一个key
+	bf            Filter
+	bfData        []byte    // 文件中的过滤器，延迟加载时第一次使用才解码
+	bfOnce        sync.Once // 延迟加载过滤器
+	bfLoaded      uint32    // 过滤器已加载(atomic)
+	rangeFilter   *RangeFilter
+	tombstones    uint64 // 删除标记个数
 	minKey        int
 	maxKey        int
 }
 
-// @param capacity - 最大存多少个kv对
-func NewDiskRun(capacity uint64, pageSize uint32, level int, runID int, bffp float64) *DiskRun {
-	filename := "C_" + strconv.Itoa(level) + "_" + strconv.Itoa(runID) + ".txt"
-	fd, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0x0600)
-	if err != nil {
-		panic(err)
-	}
+func runFileName(dir string, fileNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.run", fileNum))
+}
 
-	// 设置读写位置
-	filesize := capacity * uint64(unsafe.Sizeof(KVPair{}))
-	if _, err := fd.Seek(int64(filesize-1), os.SEEK_SET); err != nil {
-		panic(err)
+// parseRunFileName 解析run文件名，返回文件编号。只接受runFileName生成的名字，7.run、2024.run这类文件不是run文件
+func parseRunFileName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".run") {
+		return 0, false
 	}
+	fileNum, err := strconv.ParseUint(strings.TrimSuffix(name, ".run"), 10, 64)
+	if err != nil || fmt.Sprintf("%06d.run", fileNum) != name {
+		return 0, false
+	}
+	return fileNum, true
+}
 
-	if _, err := fd.Write([]byte{'\n'}); err != nil {
+// OpenDiskRun 打开已有的run文件
+// @param lazyFilter - 是否在第一次查找时才加载过滤器
+func OpenDiskRun(dir string, fileNum uint64, lazyFilter bool) *DiskRun {
+	filename := runFileName(dir, fileNum)
+	fd, err := os.OpenFile(filename, os.O_RDONLY, 0600)
+	if err != nil {
 		panic(err)
 	}
-
-	//与其它所有映射这个对象的进程共享映射空间。对共享区的写入，相当于输出到文件
-	// https://nieyong.github.io/wiki_cpu/mmap%E8%AF%A6%E8%A7%A3.html
-	b, err := syscall.Mmap(int(fd.Fd()), 0, int(filesize),
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	dr, err := mapDiskRun(fd, filename, fileNum)
 	if err != nil {
 		fd.Close()
-		panic(err)
+		panic(fmt.Errorf("open %v err[%v]", filename, err))
+	}
+	if !lazyFilter {
+		dr.loadFilter()
 	}
+	return dr
+}
 
-	sz := int(unsafe.Sizeof(KVPair{}))
-	sh := reflect.SliceHeader{
-		Data: uintptr(unsafe.Pointer(&b[0])),
-		Len:  len(b) / sz,
-		Cap:  len(b) / sz,
+// mapDiskRun 只读映射整个文件并解析文件尾
+func mapDiskRun(fd *os.File, filename string, fileNum uint64) (*DiskRun, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, err
 	}
 
-	data := *(*[]KVPair)(unsafe.Pointer(&sh))
-	return &DiskRun{
+	//与其它所有映射这个对象的进程共享映射空间
+	// https://nieyong.github.io/wiki_cpu/mmap%E8%AF%A6%E8%A7%A3.html
+	b, err := syscall.Mmap(int(fd.Fd()), 0, int(st.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &DiskRun{
 		dataref:  b,
-		data:     data,
+		fileNum:  fileNum,
 		filename: filename,
 		fd:       fd,
-		level:    level,
-		capacity: capacity,
-		pageSize: uint64(pageSize),
 		minKey:   math.MinInt64,
 		maxKey:   math.MinInt64,
-		bffp:     bffp,
-		bf:       NewBloomFilter(capacity, bffp),
 	}
+	if err := dr.readFooter(); err != nil {
+		syscall.Munmap(b)
+		return nil, err
+	}
+	if dr.mapped() && dr.capacity > 0 {
+		if dr.pageOffsets[dr.numPages()] != dr.capacity*uint64(unsafe.Sizeof(KVPair{})) {
+			syscall.Munmap(b)
+			return nil, errCorruptRun
+		}
+		dr.data = unsafe.Slice((*KVPair)(unsafe.Pointer(&b[0])), dr.capacity)
+	}
+	return dr, nil
+}
+
+func (dr *DiskRun) readFooter() error {
+	b := dr.dataref
+	if len(b) < runTrailerSize || binary.LittleEndian.Uint32(b[len(b)-4:]) != runMagic {
+		return errCorruptRun
+	}
+	n := uint64(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if n > uint64(len(b)-runTrailerSize) {
+		return errCorruptRun
+	}
+	footerStart := uint64(len(b)-runTrailerSize) - n
+	footer := b[footerStart : len(b)-runTrailerSize]
+
+	corrupt := false
+	next := func() uint64 {
+		v, k := binary.Uvarint(footer)
+		if k <= 0 {
+			corrupt = true
+			return 0
+		}
+		footer = footer[k:]
+		return v
+	}
+	nextInt := func() int {
+		v, k := binary.Varint(footer)
+		if k <= 0 {
+			corrupt = true
+			return 0
+		}
+		footer = footer[k:]
+		return int(v)
+	}
+	if len(footer) < 2 {
+		return errCorruptRun
+	}
+	dr.compressor = getCompressor(footer[0])
+	dr.encoding = PageEncoding(footer[1])
+	if dr.encoding != RawEncoding && dr.encoding != DeltaEncoding {
+		return errCorruptRun
+	}
+	footer = footer[2:]
+	dr.capacity = next()
+	dr.tombstones = next()
+	dr.pageSize = next()
+	numPages := next()
+	if corrupt || dr.pageSize == 0 || numPages > footerStart+1 {
+		return errCorruptRun
+	}
+	dr.pageOffsets = make([]uint64, 0, numPages+1)
+	var off uint64
+	dr.pageOffsets = append(dr.pageOffsets, off)
+	for i := uint64(0); i < numPages; i++ {
+		off += next()
+		dr.pageOffsets = append(dr.pageOffsets, off)
+	}
+
+	dr.minKey = nextInt()
+	dr.maxKey = nextInt()
+	dr.fencePointers = make([]int, 0, numPages)
+	for i := uint64(0); i < numPages && !corrupt; i++ {
+		dr.fencePointers = append(dr.fencePointers, nextInt())
+	}
+	bfLen := next()
+	rfLen := next()
+	if corrupt || len(footer) != 0 || off+bfLen+rfLen != footerStart {
+		return errCorruptRun
+	}
+	dr.bfData = b[off : off+bfLen]
+	if rfLen > 0 {
+		dr.rangeFilter = &RangeFilter{}
+		if err := dr.rangeFilter.UnmarshalBinary(b[off+bfLen : footerStart]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFilter 解码文件中的过滤器
+func (dr *DiskRun) loadFilter() {
+	dr.bfOnce.Do(func() {
+		defer atomic.StoreUint32(&dr.bfLoaded, 1)
+		if dr.bf != nil {
+			return
+		}
+		bf, err := unmarshalFilter(dr.bfData)
+		if err != nil {
+			panic(fmt.Errorf("%v filter err[%v]", dr.filename, err))
+		}
+		dr.bf = bf
+		dr.bfData = nil
+	})
+}
+
+// loadedFilter 返回已经加载的过滤器，延迟加载还没用到时返回nil，不触发加载
+func (dr *DiskRun) loadedFilter() Filter {
+	if atomic.LoadUint32(&dr.bfLoaded) == 0 {
+		return nil
+	}
+	return dr.bf
+}
+
+// MayContain key是否可能在run中
+func (dr *DiskRun) MayContain(key int) bool {
+	return dr.filter().MayContain(encodeInt(key))
+}
+
+// filter 返回run的点查询过滤器，需要时加载
+func (dr *DiskRun) filter() Filter {
+	dr.loadFilter()
+	return dr.bf
 }
 
 func (dr *DiskRun) Close() {
 	dr.doUnmap()
 }
 
-func (dr *DiskRun) ChangeRunID(id int) {
-	dr.runID = id
-
-	newName := fmt.Sprintf("C_%v_%v.txt", dr.level, dr.runID)
-	if err := os.Rename(dr.filename, newName); err != nil {
-		panic(fmt.Errorf("rename %v to %v err[%v]", dr.filename, newName, err))
+// Remove 关闭并删除run文件，只能在manifest不再引用它之后调用
+func (dr *DiskRun) Remove() {
+	dr.Close()
+	if err := os.Remove(dr.filename); err != nil {
+		panic(err)
 	}
-	dr.filename = newName
 }
 
 func (dr *DiskRun) doUnmap() {
+	if dr.fd == nil {
+		return
+	}
 	if err := syscall.Munmap(dr.dataref); err != nil {
 		panic(err)
 	}
@@ -103,126 +261,227 @@ func (dr *DiskRun) doUnmap() {
 	}
 	dr.fd = nil
 	dr.dataref = nil
+	dr.data = nil
 }
 
-func (dr *DiskRun) WiteData(run []KVPair, offset uint32) {
-	copy(dr.data[offset:], run)
-	dr.capacity = uint64(len(run))
-}
-
-// ConstructIndex 按照pageSize记录索引
-func (dr *DiskRun) ConstructIndex() {
-	// construct fence pointers and write BF
-	//        _fencePointers.resize(0);
-	dr.iMaxFP = 0 // TODO IS THIS SAFE?
-	dr.fencePointers = make([]int, 0, dr.capacity/uint64(dr.pageSize)+1)
-	for j := uint64(0); j < dr.capacity; j++ {
-		dr.bf.Add(encodeInt(dr.data[j].Key))
-		if j%dr.pageSize == 0 {
-			dr.fencePointers = append(dr.fencePointers, dr.data[j].Key)
-			if j != 0 {
-				dr.iMaxFP++
-			}
+func (dr *DiskRun) numPages() int {
+	return len(dr.pageOffsets) - 1
+}
+
+// mapped 数据区是否直接映射成[]KVPair
+func (dr *DiskRun) mapped() bool {
+	return dr.encoding == RawEncoding && dr.compressor == nil
+}
+
+// pageBytes 返回第i页编码后的内容，压缩时需要先解压
+func (dr *DiskRun) pageBytes(i int) []byte {
+	b := dr.dataref[dr.pageOffsets[i]:dr.pageOffsets[i+1]]
+	if dr.compressor == nil {
+		return b
+	}
+	raw, err := dr.compressor.Decompress(nil, b)
+	if err != nil {
+		panic(fmt.Errorf("decompress %v page %v err[%v]", dr.filename, i, err))
+	}
+	return raw
+}
+
+// page 返回第i页的kv
+func (dr *DiskRun) page(i int) []KVPair {
+	if dr.mapped() {
+		start := uint64(i) * dr.pageSize
+		end := start + dr.pageSize
+		if end > dr.capacity {
+			end = dr.capacity
 		}
+		return dr.data[start:end]
+	}
+	if dr.cache == nil {
+		return dr.decodePage(i)
+	}
+	key := blockKey{id: dr.cacheID, fileNum: dr.fileNum, page: i}
+	if page, ok := dr.cache.get(key); ok {
+		return page
+	}
+	page := dr.decodePage(i)
+	dr.cache.set(key, page)
+	return page
+}
+
+func (dr *DiskRun) decodePage(i int) []KVPair {
+	b := dr.pageBytes(i)
+	if dr.encoding == RawEncoding {
+		return decodeRawPage(b)
 	}
-	dr.minKey = (dr.data[0].Key)
-	dr.maxKey = (dr.data[dr.capacity-1].Key)
+	p, err := newDeltaPage(b)
+	if err != nil {
+		panic(fmt.Errorf("%v page %v err[%v]", dr.filename, i, err))
+	}
+	return p.decode()
 }
 
-func (dr *DiskRun) SetCapacity(newCap uint64) {
-	dr.capacity = newCap
+// pageIndex 查找key所在的页：最后一个不大于key的fence pointer
+func (dr *DiskRun) pageIndex(key int) int {
+	i := sort.Search(len(dr.fencePointers), func(i int) bool {
+		return dr.fencePointers[i] > key
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i
 }
 
 func (dr *DiskRun) Lookup(key int) (int, bool) {
-	idx, found := dr.GetIndex(key)
-	if found {
-		return dr.data[idx].Value, true
+	if dr.capacity == 0 {
+		return 0, false
+	}
+	if dr.encoding == DeltaEncoding && dr.cache == nil {
+		// 没有缓存时差值编码的页不需要解码整页
+		i := dr.pageIndex(key)
+		p, err := newDeltaPage(dr.pageBytes(i))
+		if err != nil {
+			panic(fmt.Errorf("%v page %v err[%v]", dr.filename, i, err))
+		}
+		return p.lookup(key)
+	}
+	page := dr.page(dr.pageIndex(key))
+	i := searchPage(page, key)
+	if i < len(page) && page[i].Key == key {
+		return page[i].Value, true
 	}
 	return 0, false
 }
 
-// GetIndex 获得key的索引
-func (dr *DiskRun) GetIndex(key int) (uint64, bool) {
-	var start, end = dr.getFlankingFp(key)
-	return dr.binarySearch(start, end-start, key)
+// searchPage 返回页中第一个不小于key的位置
+func searchPage(page []KVPair, key int) int {
+	return sort.Search(len(page), func(i int) bool {
+		return page[i].Key >= key
+	})
 }
 
-// 查找key所在的段
-func (dr *DiskRun) getFlankingFp(key int) (start, end uint64) {
-	if dr.iMaxFP == 0 { // 只有一段
-		start = 0
-		end = dr.capacity
-	} else if key < dr.fencePointers[1] { // 第一段
-		start = 0
-		end = uint64(dr.pageSize)
-	} else if key >= dr.fencePointers[dr.iMaxFP] { // 最后一段
-		start = dr.iMaxFP * uint64(dr.pageSize)
-		end = dr.capacity
-	} else {
-		// 2分查找
-		min, max := uint64(0), dr.iMaxFP
-		for min < max {
-			middle := (min + max) >> 1
-			if key > dr.fencePointers[middle] {
-				if key < dr.fencePointers[middle+1] {
-					start = middle * dr.pageSize
-					end = (middle + 1) * dr.pageSize
-					return // TODO THIS IS ALSO GROSS
-				}
-				min = middle + 1
-			} else if key < dr.fencePointers[middle] {
-				if key >= dr.fencePointers[middle-1] {
-					start = (middle - 1) * dr.pageSize
-					end = middle * dr.pageSize
-					return // TODO THIS IS ALSO GROSS. THIS WILL BREAK IF YOU DON'T KEEP TRACK OF MIN AND MAX.
-				}
-				max = middle - 1
-			} else {
-				start = middle * dr.pageSize
-				end = start
-				return
-			}
+// overlaps run的key范围是否和ranges中的某个闭区间[min, max]重叠
+func (dr *DiskRun) overlaps(ranges [][2]int) bool {
+	for _, rg := range ranges {
+		if dr.capacity > 0 && rg[0] <= dr.maxKey && rg[1] >= dr.minKey {
+			return true
 		}
 	}
-	panic("getFlankingFp")
+	return false
+}
+
+// MayContainRange [key1, key2)中是否可能有key
+func (dr *DiskRun) MayContainRange(key1, key2 int) bool {
+	if dr.capacity == 0 || key1 > dr.maxKey || key2 <= dr.minKey {
+		return false
+	}
+	return dr.rangeFilter == nil || dr.rangeFilter.MayContainRange(key1, key2)
+}
+
+// GetAllInRange 返回[key1, key2)中的kv。范围过滤器判断没有key时不创建迭代器，一页也不读
+func (dr *DiskRun) GetAllInRange(key1, key2 int) []KVPair {
+	if !dr.MayContainRange(key1, key2) {
+		return nil
+	}
+	it := dr.NewIterator()
+	if !it.SeekRange(key1, key2) {
+		return nil
+	}
+	vec := make([]KVPair, 0, 8)
+	for ; it.Valid() && it.Value().Key < key2; it.Next() {
+		vec = append(vec, it.Value())
+	}
+	return vec
+}
+
+// GetCapacity 获得元素个数
+func (dr *DiskRun) GetCapacity() uint64 {
+	return dr.capacity
+}
+
+// GetTombstones 获得删除标记个数
+func (dr *DiskRun) GetTombstones() uint64 {
+	return dr.tombstones
 }
 
-func (dr *DiskRun) binarySearch(offset uint64, n uint64, key int) (uint64, bool) {
-	if n == 0 { // 找到了
-		return offset, true
+// tombstoneRatio 删除标记占kv个数的比例
+func (dr *DiskRun) tombstoneRatio() float64 {
+	if dr.capacity == 0 {
+		return 0
 	}
-	min, max := offset, offset+n-1
-	for min <= max {
-		middle := (min + max) >> 1
-		if key > dr.data[middle].Key {
-			min = middle + 1
-		} else if key == dr.data[middle].Key {
-			return middle, true
-		} else {
-			max = middle - 1
+	return float64(dr.tombstones) / float64(dr.capacity)
+}
+
+// NewIterator 返回指向第一个kv的迭代器
+func (dr *DiskRun) NewIterator() *RunIterator {
+	return dr.newLimitedIterator(nil)
+}
+
+// newLimitedIterator 读每页前向rl申请这一页在文件中的字节数，合并时使用
+func (dr *DiskRun) newLimitedIterator(rl *RateLimiter) *RunIterator {
+	it := &RunIterator{dr: dr, pageIdx: -1, limiter: rl}
+	it.loadPage(0)
+	return it
+}
+
+// RunIterator 按key从小到大遍历DiskRun
+type RunIterator struct {
+	dr      *DiskRun
+	pageIdx int
+	page    []KVPair
+	i       int
+	limiter *RateLimiter
+}
+
+func (it *RunIterator) loadPage(i int) {
+	it.pageIdx = i
+	it.i = 0
+	if i < it.dr.numPages() {
+		if it.limiter != nil {
+			it.limiter.Wait(int(it.dr.pageOffsets[i+1] - it.dr.pageOffsets[i]))
 		}
+		it.page = it.dr.page(i)
+	} else {
+		it.page = nil
+	}
+}
+
+func (it *RunIterator) Valid() bool {
+	return it.i < len(it.page)
+}
+
+func (it *RunIterator) Value() KVPair {
+	return it.page[it.i]
+}
+
+func (it *RunIterator) Next() {
+	it.i++
+	if it.i >= len(it.page) && it.page != nil {
+		it.loadPage(it.pageIdx + 1)
 	}
-	return min, false
 }
 
-func (dr *DiskRun) Range(key1 int, key2 int) (i1 uint64, i2 uint64) {
-	if key1 > dr.maxKey || key2 < dr.minKey {
+// Seek 定位到第一个不小于key的kv
+func (it *RunIterator) Seek(key int) {
+	if it.dr.capacity == 0 {
 		return
 	}
-	if key1 < dr.minKey {
-		i1 = 0
-	} else {
-		i1, _ = dr.GetIndex(key1)
+	p := it.dr.pageIndex(key)
+	if p != it.pageIdx {
+		it.loadPage(p)
 	}
-	if key2 > dr.maxKey {
-		i2 = dr.capacity
-	} else {
-		i2, _ = dr.GetIndex(key2)
+	it.i = searchPage(it.page, key)
+	if it.i >= len(it.page) {
+		it.loadPage(p + 1)
 	}
-	return i1, i2
 }
 
-// GetCapacity 获得最多的元素个数
-func (dr *DiskRun) GetCapacity() uint64 {
-	return dr.capacity
+// SeekRange 短范围扫描用：范围过滤器判断[key1, key2)中没有key时直接结束，不再读页；
+// 否则同Seek(key1)。返回迭代器是否可能还有范围内的kv
+func (it *RunIterator) SeekRange(key1, key2 int) bool {
+	if !it.dr.MayContainRange(key1, key2) {
+		it.pageIdx, it.page, it.i = it.dr.numPages(), nil, 0
+		return false
+	}
+	it.Seek(key1)
+	return it.Valid()
 }
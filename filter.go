@@ -0,0 +1,108 @@
+package slsm
+
+import (
+	"encoding"
+	"fmt"
+)
+
+// FilterType 点查询过滤器的种类，写入run文件
+type FilterType uint8
+
+const (
+	// BloomFilterType 标准布隆过滤器
+	BloomFilterType FilterType = 0
+	// BlockedBloomFilterType 分块布隆过滤器，一个key的所有位都在同一个cache line中
+	BlockedBloomFilterType FilterType = 1
+	// XorFilterType xor过滤器，只能一次性构建，用于磁盘run
+	XorFilterType FilterType = 2
+	// CuckooFilterType 布谷鸟过滤器，支持删除
+	CuckooFilterType FilterType = 3
+)
+
+// Filter 点查询过滤器：MayContain返回false时key一定不存在。
+// 序列化后写入run文件，重新打开时按种类解码
+type Filter interface {
+	Add(key []byte)
+	MayContain(key []byte) bool
+	// SetHasher 设置hash函数和种子，必须在Add之前调用
+	SetHasher(h Hasher, seed uint32)
+	encoding.BinaryMarshaler
+	hashFunc() *filterHash
+}
+
+// NewFilter 创建指定种类的过滤器，使用默认的hash函数
+// @param n - 预估元素个数
+// @param p - 误判率，xor和布谷鸟过滤器据此选择指纹位数
+func NewFilter(t FilterType, n uint64, p float64) Filter {
+	switch t {
+	case BloomFilterType:
+		return NewBloomFilter(n, p)
+	case BlockedBloomFilterType:
+		return NewBlockedBloomFilter(n, p)
+	case XorFilterType:
+		return NewXorFilter(n, p)
+	case CuckooFilterType:
+		return NewCuckooFilter(n, p)
+	}
+	panic(fmt.Errorf("slsm: unknown filter type %v", t))
+}
+
+// newFilterWithHash 创建使用指定hash函数和种子的过滤器，h为nil时使用默认的hash函数
+func newFilterWithHash(t FilterType, n uint64, p float64, h Hasher, seed uint32) Filter {
+	f := NewFilter(t, n, p)
+	f.SetHasher(h, seed)
+	return f
+}
+
+// marshalFilter 编码: 过滤器种类(1字节) | hash函数ID(1字节) | hash种子(4字节) | 过滤器
+func marshalFilter(f Filter) ([]byte, error) {
+	var t FilterType
+	switch f.(type) {
+	case *BloomFilter:
+		t = BloomFilterType
+	case *BlockedBloomFilter:
+		t = BlockedBloomFilterType
+	case *XorFilter:
+		t = XorFilterType
+	case *CuckooFilter:
+		t = CuckooFilterType
+	default:
+		return nil, fmt.Errorf("slsm: unknown filter %T", f)
+	}
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := f.hashFunc().appendHash([]byte{byte(t)})
+	return append(b, data...), nil
+}
+
+func unmarshalFilter(data []byte) (Filter, error) {
+	if len(data) < 1 {
+		return nil, errCorruptFilter
+	}
+	var f interface {
+		Filter
+		encoding.BinaryUnmarshaler
+	}
+	switch FilterType(data[0]) {
+	case BloomFilterType:
+		f = &BloomFilter{}
+	case BlockedBloomFilterType:
+		f = &BlockedBloomFilter{}
+	case XorFilterType:
+		f = &XorFilter{}
+	case CuckooFilterType:
+		f = &CuckooFilter{}
+	default:
+		return nil, errCorruptFilter
+	}
+	data, err := f.hashFunc().readHash(data[1:])
+	if err != nil {
+		return nil, err
+	}
+	if err := f.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
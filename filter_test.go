@@ -0,0 +1,113 @@
+package slsm
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+var filterTypes = []struct {
+	name string
+	t    FilterType
+}{
+	{"bloom", BloomFilterType},
+	{"blocked_bloom", BlockedBloomFilterType},
+	{"xor", XorFilterType},
+	{"cuckoo", CuckooFilterType},
+}
+
+// filterKeys 返回n个随机key和n个不在其中的key
+func filterKeys(n int) ([][]byte, [][]byte) {
+	r := rand.New(rand.NewSource(1))
+	keys := make([][]byte, n)
+	misses := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		keys[i] = []byte(strconv.FormatInt(r.Int63(), 10))
+		misses[i] = []byte(strconv.FormatInt(-r.Int63()-1, 10))
+	}
+	return keys, misses
+}
+
+func TestFilterFalsePositiveRate(t *testing.T) {
+	const n = 100000
+	keys, misses := filterKeys(n)
+	for _, ft := range filterTypes {
+		for _, p := range []float64{0.01, 0.001} {
+			f := NewFilter(ft.t, n, p)
+			for _, k := range keys {
+				f.Add(k)
+			}
+			for _, k := range keys {
+				if !f.MayContain(k) {
+					t.Fatalf("%v: false negative", ft.name)
+				}
+			}
+			falsePositives := 0
+			for _, k := range misses {
+				if f.MayContain(k) {
+					falsePositives++
+				}
+			}
+			if fpr := float64(falsePositives) / n; fpr > p*1.3 {
+				t.Errorf("%v: p=%v measured false positive rate %v", ft.name, p, fpr)
+			}
+		}
+	}
+}
+
+func TestBlockedBloomExtremeRates(t *testing.T) {
+	const n = 10000
+	keys, misses := filterKeys(n)
+	for _, p := range []float64{0, -1, 1e-30, math.NaN()} {
+		f := NewBlockedBloomFilter(n, p)
+		if bitsPerKey := float64(len(f.blocks)*64) / n; bitsPerKey > blockedBloomMaxBitsPerKey+1 {
+			t.Fatalf("p=%v: %v bits per key", p, bitsPerKey)
+		}
+		for _, k := range keys {
+			f.Add(k)
+		}
+		for _, k := range keys {
+			if !f.MayContain(k) {
+				t.Fatalf("p=%v: false negative", p)
+			}
+		}
+		for _, k := range misses {
+			if f.MayContain(k) {
+				t.Fatalf("p=%v: false positive", p)
+			}
+		}
+	}
+	if f := NewBlockedBloomFilter(n, 1); !f.MayContain(keys[0]) {
+		t.Fatalf("p=1 should pass every key")
+	}
+}
+
+// BenchmarkFilter 比较各种过滤器的查询吞吐和实测误判率
+func BenchmarkFilter(b *testing.B) {
+	const n = 1000000
+	const fp = 0.01
+	keys, misses := filterKeys(n)
+	for _, ft := range filterTypes {
+		f := NewFilter(ft.t, n, fp)
+		for _, k := range keys {
+			f.Add(k)
+		}
+		data, _ := f.MarshalBinary()
+		b.Run(ft.name+"/hit", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				f.MayContain(keys[i%n])
+			}
+			b.ReportMetric(float64(len(data))*8/n, "bits/key")
+		})
+		b.Run(ft.name+"/miss", func(b *testing.B) {
+			falsePositives := 0
+			for i := 0; i < b.N; i++ {
+				if f.MayContain(misses[i%n]) {
+					falsePositives++
+				}
+			}
+			b.ReportMetric(float64(falsePositives)/float64(b.N), "fpr")
+		})
+	}
+}
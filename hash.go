@@ -1,6 +1,18 @@
 package slsm
 
-import "unsafe"
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	murmurC1_128 uint64 = 0x87c37b91114253d5
+	murmurC2_128 uint64 = 0x4cf5ad432745937f
+
+	murmurC1_32 uint32 = 0xcc9e2d51
+	murmurC2_32 uint32 = 0x1b873593
+)
 
 func rotl64(x, r uint64) uint64 {
 	return (x << r) | (x >> (64 - r))
@@ -16,53 +28,50 @@ func fmix64(k uint64) uint64 {
 	return k
 }
 
-func MurmurHash3_x64_128(key []byte, seed uint32) (uint64, uint64) {
-	nblocks := len(key) / 16
-
-	h1 := uint64(seed)
-	h2 := uint64(seed)
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
 
-	var c1 uint64 = 0x87c37b91114253d5
-	var c2 uint64 = 0x4cf5ad432745937f
-
-	//----------
-	// body
-
-	blocks := key
+	return h
+}
 
-	for i := 0; i < nblocks; i++ {
-		t := (*[2]uint64)(unsafe.Pointer(&blocks[i*16]))
-		k1 := t[0]
-		k2 := t[1]
+// murmur128Blocks 处理若干个完整的16字节块
+func murmur128Blocks(h1, h2 uint64, blocks []byte) (uint64, uint64) {
+	for ; len(blocks) >= 16; blocks = blocks[16:] {
+		k1 := binary.LittleEndian.Uint64(blocks)
+		k2 := binary.LittleEndian.Uint64(blocks[8:])
 
-		k1 *= c1
+		k1 *= murmurC1_128
 		k1 = rotl64(k1, 31)
-		k1 *= c2
+		k1 *= murmurC2_128
 		h1 ^= k1
 
 		h1 = rotl64(h1, 27)
 		h1 += h2
 		h1 = h1*5 + 0x52dce729
 
-		k2 *= c2
+		k2 *= murmurC2_128
 		k2 = rotl64(k2, 33)
-		k2 *= c1
+		k2 *= murmurC1_128
 		h2 ^= k2
 
 		h2 = rotl64(h2, 31)
 		h2 += h1
 		h2 = h2*5 + 0x38495ab5
 	}
+	return h1, h2
+}
 
-	//----------
-	// tail
-
-	tail := key[nblocks*16:]
-
+// murmur128Finish 处理不足16字节的尾部并做最后的混合
+// @param length - 输入的总字节数
+func murmur128Finish(h1, h2 uint64, tail []byte, length uint64) (uint64, uint64) {
 	var k1 uint64
 	var k2 uint64
 
-	switch len(key) & 15 {
+	switch len(tail) & 15 {
 	case 15:
 		k2 ^= uint64(tail[14]) << 48
 		fallthrough
@@ -84,9 +93,9 @@ func MurmurHash3_x64_128(key []byte, seed uint32) (uint64, uint64) {
 	case 9:
 		k2 ^= uint64(tail[8]) << 0
 
-		k2 *= c2
+		k2 *= murmurC2_128
 		k2 = rotl64(k2, 33)
-		k2 *= c1
+		k2 *= murmurC1_128
 		h2 ^= k2
 		fallthrough
 	case 8:
@@ -113,17 +122,17 @@ func MurmurHash3_x64_128(key []byte, seed uint32) (uint64, uint64) {
 	case 1:
 		k1 ^= uint64(tail[0]) << 0
 
-		k1 *= c1
+		k1 *= murmurC1_128
 		k1 = rotl64(k1, 31)
-		k1 *= c2
+		k1 *= murmurC2_128
 		h1 ^= k1
 	}
 
 	//----------
 	// finalization
 
-	h1 ^= uint64(len(key))
-	h2 ^= uint64(len(key))
+	h1 ^= length
+	h2 ^= length
 
 	h1 += h2
 	h2 += h1
@@ -136,3 +145,182 @@ func MurmurHash3_x64_128(key []byte, seed uint32) (uint64, uint64) {
 
 	return h1, h2
 }
+
+func MurmurHash3_x64_128(key []byte, seed uint32) (uint64, uint64) {
+	nblocks := len(key) / 16
+	h1, h2 := murmur128Blocks(uint64(seed), uint64(seed), key[:nblocks*16])
+	return murmur128Finish(h1, h2, key[nblocks*16:], uint64(len(key)))
+}
+
+func murmur32Blocks(h1 uint32, blocks []byte) uint32 {
+	for ; len(blocks) >= 4; blocks = blocks[4:] {
+		k1 := binary.LittleEndian.Uint32(blocks)
+
+		k1 *= murmurC1_32
+		k1 = bits.RotateLeft32(k1, 15)
+		k1 *= murmurC2_32
+
+		h1 ^= k1
+		h1 = bits.RotateLeft32(h1, 13)
+		h1 = h1*5 + 0xe6546b64
+	}
+	return h1
+}
+
+func murmur32Finish(h1 uint32, tail []byte, length uint32) uint32 {
+	var k1 uint32
+
+	switch len(tail) & 3 {
+	case 3:
+		k1 ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k1 ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k1 ^= uint32(tail[0])
+
+		k1 *= murmurC1_32
+		k1 = bits.RotateLeft32(k1, 15)
+		k1 *= murmurC2_32
+		h1 ^= k1
+	}
+
+	h1 ^= length
+	return fmix32(h1)
+}
+
+// MurmurHash3_x86_32 32位的MurmurHash3
+func MurmurHash3_x86_32(key []byte, seed uint32) uint32 {
+	nblocks := len(key) / 4
+	h1 := murmur32Blocks(seed, key[:nblocks*4])
+	return murmur32Finish(h1, key[nblocks*4:], uint32(len(key)))
+}
+
+// Murmur3 流式的MurmurHash3_x64_128，实现hash.Hash。
+// 分几次Write和把所有数据拼起来一次计算的结果相同，可以直接对组合key逐段计算
+type Murmur3 struct {
+	seed   uint32
+	h1, h2 uint64
+	buf    [16]byte // 不足一块的数据
+	nbuf   int
+	length uint64
+}
+
+var _ hash.Hash = (*Murmur3)(nil)
+
+// NewMurmur3 new
+func NewMurmur3(seed uint32) *Murmur3 {
+	m := &Murmur3{seed: seed}
+	m.Reset()
+	return m
+}
+
+func (m *Murmur3) Write(p []byte) (int, error) {
+	n := len(p)
+	m.length += uint64(n)
+	if m.nbuf > 0 {
+		c := copy(m.buf[m.nbuf:], p)
+		m.nbuf += c
+		p = p[c:]
+		if m.nbuf < len(m.buf) {
+			return n, nil
+		}
+		m.h1, m.h2 = murmur128Blocks(m.h1, m.h2, m.buf[:])
+		m.nbuf = 0
+	}
+	nblocks := len(p) / 16
+	m.h1, m.h2 = murmur128Blocks(m.h1, m.h2, p[:nblocks*16])
+	m.nbuf = copy(m.buf[:], p[nblocks*16:])
+	return n, nil
+}
+
+// Sum128 返回目前写入的所有数据的hash，不改变状态
+func (m *Murmur3) Sum128() (uint64, uint64) {
+	return murmur128Finish(m.h1, m.h2, m.buf[:m.nbuf], m.length)
+}
+
+// Sum 把h1、h2按大端追加到b后
+func (m *Murmur3) Sum(b []byte) []byte {
+	h1, h2 := m.Sum128()
+	var out [16]byte
+	binary.BigEndian.PutUint64(out[:], h1)
+	binary.BigEndian.PutUint64(out[8:], h2)
+	return append(b, out[:]...)
+}
+
+func (m *Murmur3) Reset() {
+	m.h1, m.h2 = uint64(m.seed), uint64(m.seed)
+	m.nbuf = 0
+	m.length = 0
+}
+
+func (m *Murmur3) Size() int {
+	return 16
+}
+
+func (m *Murmur3) BlockSize() int {
+	return 16
+}
+
+// Murmur3_32 流式的MurmurHash3_x86_32，实现hash.Hash32
+type Murmur3_32 struct {
+	seed   uint32
+	h1     uint32
+	buf    [4]byte
+	nbuf   int
+	length uint32
+}
+
+var _ hash.Hash32 = (*Murmur3_32)(nil)
+
+// NewMurmur3_32 new
+func NewMurmur3_32(seed uint32) *Murmur3_32 {
+	m := &Murmur3_32{seed: seed}
+	m.Reset()
+	return m
+}
+
+func (m *Murmur3_32) Write(p []byte) (int, error) {
+	n := len(p)
+	m.length += uint32(n)
+	if m.nbuf > 0 {
+		c := copy(m.buf[m.nbuf:], p)
+		m.nbuf += c
+		p = p[c:]
+		if m.nbuf < len(m.buf) {
+			return n, nil
+		}
+		m.h1 = murmur32Blocks(m.h1, m.buf[:])
+		m.nbuf = 0
+	}
+	nblocks := len(p) / 4
+	m.h1 = murmur32Blocks(m.h1, p[:nblocks*4])
+	m.nbuf = copy(m.buf[:], p[nblocks*4:])
+	return n, nil
+}
+
+// Sum32 返回目前写入的所有数据的hash，不改变状态
+func (m *Murmur3_32) Sum32() uint32 {
+	return murmur32Finish(m.h1, m.buf[:m.nbuf], m.length)
+}
+
+// Sum 把hash按大端追加到b后
+func (m *Murmur3_32) Sum(b []byte) []byte {
+	h := m.Sum32()
+	return append(b, byte(h>>24), byte(h>>16), byte(h>>8), byte(h))
+}
+
+func (m *Murmur3_32) Reset() {
+	m.h1 = m.seed
+	m.nbuf = 0
+	m.length = 0
+}
+
+func (m *Murmur3_32) Size() int {
+	return 4
+}
+
+func (m *Murmur3_32) BlockSize() int {
+	return 4
+}
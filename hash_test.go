@@ -0,0 +1,95 @@
+package slsm
+
+import "testing"
+
+const quickFox = "The quick brown fox jumps over the lazy dog"
+
+func TestMurmurHash3x86_32Vectors(t *testing.T) {
+	tests := []struct {
+		key  string
+		seed uint32
+		want uint32
+	}{
+		{"", 0, 0},
+		{"", 1, 0x514e28b7},
+		{"", 0xffffffff, 0x81f16f39},
+		{"Hello, world!", 1234, 0xfaf6cdb3},
+		{quickFox, 0x9747b28c, 0x2fa826cd},
+		{quickFox, 0, 0x2e4ff723},
+	}
+	for _, tt := range tests {
+		if got := MurmurHash3_x86_32([]byte(tt.key), tt.seed); got != tt.want {
+			t.Errorf("MurmurHash3_x86_32(%q, %#x) = %#x, want %#x", tt.key, tt.seed, got, tt.want)
+		}
+	}
+}
+
+func TestMurmurHash3x64_128Vectors(t *testing.T) {
+	tests := []struct {
+		key    string
+		seed   uint32
+		h1, h2 uint64
+	}{
+		{"", 0, 0, 0},
+		{"hello", 0, 0xcbd8a7b341bd9b02, 0x5b1e906a48ae1d19},
+		{"Hello, world!", 123, 0x421c8c738743acad, 0xf19732fdd373c3f5},
+		{quickFox, 0, 0xe34bbc7bbc071b6c, 0x7a433ca9c49a9347},
+	}
+	for _, tt := range tests {
+		h1, h2 := MurmurHash3_x64_128([]byte(tt.key), tt.seed)
+		if h1 != tt.h1 || h2 != tt.h2 {
+			t.Errorf("MurmurHash3_x64_128(%q, %v) = %#x %#x, want %#x %#x", tt.key, tt.seed, h1, h2, tt.h1, tt.h2)
+		}
+	}
+}
+
+func TestXXHash64Vectors(t *testing.T) {
+	tests := []struct {
+		key  string
+		seed uint64
+		want uint64
+	}{
+		{"", 0, 0xef46db3751d8e999},
+		{"a", 0, 0xd24ec4f1a98c6e5b},
+		{"abc", 0, 0x44bc2cf5ad770999},
+		{quickFox, 0, 0x0b242d361fda71bc},
+	}
+	for _, tt := range tests {
+		if got := xxHash64([]byte(tt.key), tt.seed); got != tt.want {
+			t.Errorf("xxHash64(%q, %v) = %#x, want %#x", tt.key, tt.seed, got, tt.want)
+		}
+	}
+}
+
+// 分几次Write的结果和一次计算相同，覆盖所有切分位置
+func TestMurmur3StreamingSplits(t *testing.T) {
+	data := []byte(quickFox + " " + quickFox)
+	for _, seed := range []uint32{0, 42} {
+		want1, want2 := MurmurHash3_x64_128(data, seed)
+		want32 := MurmurHash3_x86_32(data, seed)
+		for i := 0; i <= len(data); i++ {
+			for j := i; j <= len(data); j++ {
+				m := NewMurmur3(seed)
+				m32 := NewMurmur3_32(seed)
+				for _, part := range [][]byte{data[:i], data[i:j], data[j:]} {
+					m.Write(part)
+					m32.Write(part)
+				}
+				if h1, h2 := m.Sum128(); h1 != want1 || h2 != want2 {
+					t.Fatalf("Murmur3 split %v/%v = %#x %#x, want %#x %#x", i, j, h1, h2, want1, want2)
+				}
+				if h := m32.Sum32(); h != want32 {
+					t.Fatalf("Murmur3_32 split %v/%v = %#x, want %#x", i, j, h, want32)
+				}
+			}
+		}
+		// Reset之后重新计算
+		m := NewMurmur3(seed)
+		m.Write(data[:5])
+		m.Reset()
+		m.Write(data)
+		if h1, h2 := m.Sum128(); h1 != want1 || h2 != want2 {
+			t.Fatalf("Murmur3 after reset = %#x %#x", h1, h2)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package slsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"reflect"
+	"sync"
+)
+
+// 内置hash函数的ID，和种子一起写入过滤器，重新打开时据此找到同一个hash函数
+const (
+	Murmur3Hash uint8 = 0
+	XXHash      uint8 = 1
+	FNVHash     uint8 = 2
+)
+
+// Hasher 过滤器使用的hash函数
+type Hasher interface {
+	// ID 唯一标识
+	ID() uint8
+	// Sum128 用seed计算key的两个64位hash，两个hash应当相互独立
+	Sum128(key []byte, seed uint32) (uint64, uint64)
+}
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[uint8]Hasher{}
+)
+
+// RegisterHasher 注册hash函数，重新打开run时按ID查找。
+// ID不能重复注册，否则已有的过滤器会用另一个hash函数查找，产生假阴性
+func RegisterHasher(h Hasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	if _, ok := hashers[h.ID()]; ok {
+		panic(fmt.Errorf("slsm: hasher id %v already registered", h.ID()))
+	}
+	hashers[h.ID()] = h
+}
+
+func getHasher(id uint8) (Hasher, bool) {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	h, ok := hashers[id]
+	return h, ok
+}
+
+// checkHasher 确保h已经注册，没有注册时注册它，重新打开时才能找到。ID被另一种hash函数占用时panic
+func checkHasher(h Hasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	r, ok := hashers[h.ID()]
+	if !ok {
+		hashers[h.ID()] = h
+		return
+	}
+	if reflect.TypeOf(r) != reflect.TypeOf(h) {
+		panic(fmt.Errorf("slsm: hasher id %v is registered by %T, not %T", h.ID(), r, h))
+	}
+}
+
+func init() {
+	RegisterHasher(Murmur3Hasher{})
+	RegisterHasher(XXHasher{})
+	RegisterHasher(FNVHasher{})
+}
+
+// Murmur3Hasher MurmurHash3_x64_128，默认的hash函数
+type Murmur3Hasher struct{}
+
+func (Murmur3Hasher) ID() uint8 {
+	return Murmur3Hash
+}
+
+func (Murmur3Hasher) Sum128(key []byte, seed uint32) (uint64, uint64) {
+	return MurmurHash3_x64_128(key, seed)
+}
+
+// XXHasher XXH64，第二个hash由第一个hash再混合得到
+type XXHasher struct{}
+
+func (XXHasher) ID() uint8 {
+	return XXHash
+}
+
+func (XXHasher) Sum128(key []byte, seed uint32) (uint64, uint64) {
+	h := xxHash64(key, uint64(seed))
+	return h, fmix64(h + xxPrime1)
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func xxHash64(b []byte, seed uint64) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+// FNVHasher FNV-1a 64位，种子混入初始值，第二个hash由第一个hash再混合得到。
+// 速度快但分布较差，只适合key本身比较随机的场景
+type FNVHasher struct{}
+
+func (FNVHasher) ID() uint8 {
+	return FNVHash
+}
+
+func (FNVHasher) Sum128(key []byte, seed uint32) (uint64, uint64) {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64) ^ uint64(seed)*prime64
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= prime64
+	}
+	h = fmix64(h)
+	return h, fmix64(h ^ uint64(seed)<<32 ^ 0x9e3779b97f4a7c15)
+}
+
+// filterHash 过滤器使用的hash函数和种子，随过滤器一起持久化
+type filterHash struct {
+	hasher   Hasher // nil表示Murmur3Hasher
+	hashSeed uint32
+}
+
+// SetHasher 设置hash函数和种子，必须在Add之前调用
+func (fh *filterHash) SetHasher(h Hasher, seed uint32) {
+	fh.hasher = h
+	fh.hashSeed = seed
+}
+
+func (fh *filterHash) hashFunc() *filterHash {
+	return fh
+}
+
+func (fh *filterHash) sum(key []byte) (uint64, uint64) {
+	if fh.hasher == nil {
+		return MurmurHash3_x64_128(key, fh.hashSeed)
+	}
+	return fh.hasher.Sum128(key, fh.hashSeed)
+}
+
+// appendHash 编码: hash函数ID(1字节) | 种子(4字节)
+func (fh *filterHash) appendHash(b []byte) []byte {
+	id := Murmur3Hash
+	if fh.hasher != nil {
+		id = fh.hasher.ID()
+	}
+	var seed [4]byte
+	binary.LittleEndian.PutUint32(seed[:], fh.hashSeed)
+	return append(append(b, id), seed[:]...)
+}
+
+// readHash 解码appendHash写入的内容，返回剩余的数据
+func (fh *filterHash) readHash(data []byte) ([]byte, error) {
+	if len(data) < 5 {
+		return nil, errCorruptFilter
+	}
+	h, ok := getHasher(data[0])
+	if !ok {
+		return nil, fmt.Errorf("slsm: unknown hasher %v", data[0])
+	}
+	fh.SetHasher(h, binary.LittleEndian.Uint32(data[1:]))
+	return data[5:], nil
+}
@@ -0,0 +1,66 @@
+package slsm
+
+import "testing"
+
+// testHasher 测试用的hash函数，ID由类型决定
+type testHasher struct{}
+
+func (testHasher) ID() uint8 {
+	return 200
+}
+
+func (testHasher) Sum128(key []byte, seed uint32) (uint64, uint64) {
+	h := xxHash64(key, uint64(seed)+1)
+	return h, fmix64(h)
+}
+
+// conflictHasher 占用内置的ID
+type conflictHasher struct{ testHasher }
+
+func (conflictHasher) ID() uint8 {
+	return Murmur3Hash
+}
+
+func expectPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("%v: expected panic", name)
+		}
+	}()
+	f()
+}
+
+func TestRegisterHasherRejectsDuplicate(t *testing.T) {
+	expectPanic(t, "builtin id", func() { RegisterHasher(conflictHasher{}) })
+	if h, _ := getHasher(Murmur3Hash); h != (Murmur3Hasher{}) {
+		t.Fatalf("murmur3 replaced by %T", h)
+	}
+
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.Hasher = conflictHasher{}
+	expectPanic(t, "options hasher", func() { NewLSMWithOptions(o) })
+}
+
+func TestCustomHasherReopen(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 64
+	o.NumRuns = 2
+	o.Hasher = testHasher{}
+	lsm := NewLSMWithOptions(o)
+	for i := 0; i < 1000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	lsm.Close()
+
+	lsm = NewLSMWithOptions(o)
+	defer lsm.Close()
+	// 内存run关闭时不落盘，只检查已经合并到磁盘的key
+	for i := 0; i < 512; i++ {
+		if v, ok := lsm.Lookup(i); !ok || v != i {
+			t.Fatalf("lookup %v = %v, %v", i, v, ok)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package slsm
+
+import "math"
+
+// loserTree 败者树，多路归并有序的迭代器，每输出一个kv约比较log2(k)次。
+// 相同的key只输出下标最大(最新)的迭代器中的值，本身也是kvIterator
+type loserTree struct {
+	its    []kvIterator
+	leaves []loserLeaf
+	tree   []int // tree[0]是胜者，tree[1:]是各内部节点的败者，叶子i在位置k+i
+}
+
+// loserLeaf 每路当前的kv，避免比较时调用接口。结束的路key为math.MaxInt，大多数比较只需要比较key
+type loserLeaf struct {
+	kv   KVPair
+	done bool
+}
+
+func newLoserTree(its []kvIterator) *loserTree {
+	k := len(its)
+	t := &loserTree{
+		its:    its,
+		leaves: make([]loserLeaf, k),
+		tree:   make([]int, k+1),
+	}
+	for i := range its {
+		t.load(i)
+	}
+	if k > 0 {
+		t.tree[0] = t.build(1)
+	}
+	return t
+}
+
+// load 读第i路的当前kv
+func (t *loserTree) load(i int) {
+	it := t.its[i]
+	if it.Valid() {
+		t.leaves[i] = loserLeaf{kv: it.Value()}
+	} else {
+		t.leaves[i] = loserLeaf{kv: KVPair{Key: math.MaxInt}, done: true}
+	}
+}
+
+// build 计算以node为根的子树的胜者，败者记录在内部节点
+func (t *loserTree) build(node int) int {
+	k := len(t.its)
+	if node >= k {
+		return node - k
+	}
+	a, b := t.build(2*node), t.build(2*node+1)
+	if t.beats(b, a) {
+		a, b = b, a
+	}
+	t.tree[node] = b
+	return a
+}
+
+// beats a路是否排在b路前面：key小的在前，key相同时没结束的在前，都没结束时新的在前
+func (t *loserTree) beats(a, b int) bool {
+	la, lb := &t.leaves[a], &t.leaves[b]
+	if la.kv.Key != lb.kv.Key {
+		return la.kv.Key < lb.kv.Key
+	}
+	if la.done != lb.done {
+		return lb.done
+	}
+	return a > b
+}
+
+// advance 胜者那一路前进一步，从它的叶子到根重新比赛
+func (t *loserTree) advance() {
+	w := t.tree[0]
+	t.its[w].Next()
+	t.load(w)
+	for node := (w + len(t.its)) >> 1; node > 0; node >>= 1 {
+		if l := t.tree[node]; t.beats(l, w) {
+			t.tree[node], w = w, l
+		}
+	}
+	t.tree[0] = w
+}
+
+func (t *loserTree) Valid() bool {
+	return len(t.its) > 0 && !t.leaves[t.tree[0]].done
+}
+
+func (t *loserTree) Value() KVPair {
+	return t.leaves[t.tree[0]].kv
+}
+
+// Next 跳过其他路中与当前key相同的旧值
+func (t *loserTree) Next() {
+	key := t.Value().Key
+	t.advance()
+	for w := &t.leaves[t.tree[0]]; w.kv.Key == key && !w.done; w = &t.leaves[t.tree[0]] {
+		t.advance()
+	}
+}
+
+// MergeSorted 多路归并有序的kv数组，相同的key只保留下标最大(最新)的数组中的值
+func MergeSorted(runs [][]KVPair) []KVPair {
+	n := 0
+	its := make([]kvIterator, len(runs))
+	for i, kvs := range runs {
+		its[i] = &sliceIterator{kvs: kvs}
+		n += len(kvs)
+	}
+	merged := make([]KVPair, 0, n)
+	for t := newLoserTree(its); t.Valid(); t.Next() {
+		merged = append(merged, t.Value())
+	}
+	return merged
+}
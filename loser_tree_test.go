@@ -0,0 +1,130 @@
+package slsm
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestLoserTreeNewestWins(t *testing.T) {
+	runs := [][]KVPair{
+		{{1, 10}, {2, 20}, {5, 50}},
+		{{2, 21}, {3, 31}, {5, 51}},
+		{},
+		{{0, 3}, {2, 23}, {5, TOMBSTONE}},
+	}
+	want := []KVPair{{0, 3}, {1, 10}, {2, 23}, {3, 31}, {5, TOMBSTONE}}
+	got := MergeSorted(runs)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if got := MergeSorted(nil); len(got) != 0 {
+		t.Fatalf("no inputs: %v", got)
+	}
+	if got := MergeSorted([][]KVPair{{{1, 1}, {2, 2}}}); fmt.Sprint(got) != "[{1 1} {2 2}]" {
+		t.Fatalf("one input: %v", got)
+	}
+}
+
+// 和map模拟的结果比较，覆盖不是2的幂的k
+func TestLoserTreeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 500; iter++ {
+		runs := make([][]KVPair, r.Intn(70))
+		want := make(map[int]int)
+		for i := range runs {
+			keys := make(map[int]bool)
+			for j := r.Intn(50); j > 0; j-- {
+				keys[r.Intn(200)] = true
+			}
+			for k := range keys {
+				runs[i] = append(runs[i], KVPair{k, i})
+				want[k] = i
+			}
+			run := runs[i]
+			sort.Slice(run, func(a, b int) bool { return run[a].Key < run[b].Key })
+		}
+		got := MergeSorted(runs)
+		if len(got) != len(want) {
+			t.Fatalf("got %v kvs, want %v", len(got), len(want))
+		}
+		for i, kv := range got {
+			if i > 0 && got[i-1].Key >= kv.Key {
+				t.Fatalf("not sorted at %v", i)
+			}
+			if want[kv.Key] != kv.Value {
+				t.Fatalf("key %v from input %v, want %v", kv.Key, kv.Value, want[kv.Key])
+			}
+		}
+	}
+}
+
+// heapMerge 原来用StaticHeap的多路归并，作为比较的基准
+func heapMerge(its []kvIterator, emit func(KVPair)) {
+	h := NewStaticHeap(len(its))
+	for i, it := range its {
+		if it.Valid() {
+			h.Push(NewKVIntPair(it.Value(), i))
+		}
+	}
+	var last KVIntPair
+	hasLast := false
+	for h.Len() > 0 {
+		v := h.Pop()
+		if hasLast && v.Key == last.Key {
+			if last.k < v.k {
+				last = v
+			}
+		} else {
+			if hasLast {
+				emit(last.KVPair)
+			}
+			last = v
+			hasLast = true
+		}
+		its[v.k].Next()
+		if its[v.k].Valid() {
+			h.Push(NewKVIntPair(its[v.k].Value(), v.k))
+		}
+	}
+	if hasLast {
+		emit(last.KVPair)
+	}
+}
+
+// BenchmarkLoserTree k路归并有序run的吞吐，和原来的堆比较
+func BenchmarkLoserTree(b *testing.B) {
+	const n = 1 << 16
+	r := rand.New(rand.NewSource(1))
+	for k := 2; k <= 64; k *= 2 {
+		runs := make([][]KVPair, k)
+		for i := range runs {
+			run := make([]KVPair, n/k)
+			for j := range run {
+				run[j] = KVPair{Key: r.Int(), Value: j}
+			}
+			sort.Slice(run, func(a, b int) bool { return run[a].Key < run[b].Key })
+			runs[i] = run
+		}
+		iterators := func() []kvIterator {
+			its := make([]kvIterator, k)
+			for i, run := range runs {
+				its[i] = &sliceIterator{kvs: run}
+			}
+			return its
+		}
+		for _, m := range []struct {
+			name  string
+			merge func([]kvIterator, func(KVPair))
+		}{{"loser_tree", mergeIterators}, {"heap", heapMerge}} {
+			b.Run(fmt.Sprintf("k=%d/%s", k, m.name), func(b *testing.B) {
+				b.SetBytes(n * int64(kvSize))
+				for i := 0; i < b.N; i++ {
+					m.merge(iterators(), func(KVPair) {})
+				}
+			})
+		}
+	}
+}
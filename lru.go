@@ -0,0 +1,106 @@
+package slsm
+
+import (
+	"container/list"
+	"sync"
+)
+
+type lruEntry struct {
+	key    interface{}
+	value  interface{}
+	charge int64
+}
+
+// lruCache 线程安全的LRU，按charge之和限制大小
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List // 队头是最近使用的
+	items    map[interface{}]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+func newLRUCache(capacity int64) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[interface{}]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		c.hits++
+		return e.Value.(*lruEntry).value, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// Set 插入或替换，超过容量时淘汰最久未使用的
+func (c *lruCache) Set(key interface{}, value interface{}, charge int64) {
+	if charge > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		ent := e.Value.(*lruEntry)
+		c.size += charge - ent.charge
+		ent.value, ent.charge = value, charge
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, charge: charge})
+		c.size += charge
+	}
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lruCache) Delete(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *lruCache) removeElement(e *list.Element) {
+	ent := c.ll.Remove(e).(*lruEntry)
+	delete(c.items, ent.key)
+	c.size -= ent.charge
+}
+
+// CacheStats 缓存统计
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Entries  int
+	Size     int64 // 当前占用
+	Capacity int64
+}
+
+// HitRate 命中率
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s *CacheStats) add(c *lruCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.Hits += c.hits
+	s.Misses += c.misses
+	s.Entries += len(c.items)
+	s.Size += c.size
+	s.Capacity += c.capacity
+}
@@ -3,9 +3,12 @@ package slsm
 import (
 	"fmt"
 	"math"
-	"reflect"
+	"os"
+	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -16,19 +19,30 @@ const (
 type LSM struct {
 	C0        []Run // 内存run
 	activeRun int   // 当前run
-	filters   []*BloomFilter
+	filters   []Filter
 
 	diskLevels []*DiskLevel // 磁盘
+	manifest   *Manifest
 
+	opts                *Options
+	cacheID             uint64 // 在共享的BlockCache中区分不同LSM
+	rowCache            *lruCache
+	dir                 string
 	eltsPerRun          uint64 // 每个run的kv个数
 	numRuns             int    // run的最大个数
 	numToMerge          int    // 达到多少个run后merge
-	bfFalsePositiveRate float64
+	bfFalsePositiveRate uint64 // 内存run的误判率(math.Float64bits)，合并时可能被重新分配
 	mergedFrac          float64
 	diskRunsPerLevel    int // 每层磁盘run的个数
 	pageSize            uint32
 
-	mergeWg sync.WaitGroup
+	mergeWg   sync.WaitGroup       // 正在合并的内存run
+	diskMu    sync.RWMutex         // 修改磁盘层时加写锁，读磁盘层时加读锁
+	sched     *compactionScheduler // 后台合并
+	compactWg sync.WaitGroup       // 后台的手动合并
+
+	writeDelay int64         // 写入限流时每次写入的延迟(time.Duration)，由后台合并更新
+	delayed    time.Duration // 累计还没睡的延迟
 
 	V_TOMBSTONE int
 }
@@ -41,36 +55,137 @@ type LSM struct {
 // @param diskRunsPerLevel - 每层磁盘run的个数
 func NewLSM(eltsPerRun uint64, numRuns int, mergedFrac float64, bfFp float64,
 	pageSize uint32, diskRunsPerLevel int) *LSM {
+	opts := DefaultOptions()
+	opts.EltsPerRun = eltsPerRun
+	opts.NumRuns = numRuns
+	opts.MergedFrac = mergedFrac
+	opts.BloomFalsePositiveRate = bfFp
+	opts.PageSize = pageSize
+	opts.DiskRunsPerLevel = diskRunsPerLevel
+	return NewLSMWithOptions(opts)
+}
+
+// NewLSMWithOptions 打开opts.Dir下的LSM，恢复manifest中记录的磁盘run并清理残留文件
+func NewLSMWithOptions(opts *Options) *LSM {
+	if opts.MemFilterType == XorFilterType {
+		panic("slsm: xor filter can't be used for memory runs")
+	}
+	if opts.Hasher != nil {
+		checkHasher(opts.Hasher)
+	}
+	for _, c := range opts.LevelCompression {
+		if c != nil {
+			checkCompressor(c)
+		}
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		panic(err)
+	}
+
 	// 达到多少个run后merge
-	var numToMerge = int(math.Ceil(float64(numRuns) * mergedFrac))
+	var numToMerge = int(math.Ceil(float64(opts.NumRuns) * opts.MergedFrac))
 	lsm := &LSM{
-		eltsPerRun:          eltsPerRun,
-		numRuns:             numRuns,
+		opts:                opts,
+		dir:                 opts.Dir,
+		eltsPerRun:          opts.EltsPerRun,
+		numRuns:             opts.NumRuns,
 		numToMerge:          numToMerge,
-		bfFalsePositiveRate: bfFp,
-		mergedFrac:          mergedFrac,
-		pageSize:            pageSize,
-		diskRunsPerLevel:    diskRunsPerLevel,
+		bfFalsePositiveRate: math.Float64bits(opts.BloomFalsePositiveRate),
+		mergedFrac:          opts.MergedFrac,
+		pageSize:            opts.PageSize,
+		diskRunsPerLevel:    opts.DiskRunsPerLevel,
 		V_TOMBSTONE:         TOMBSTONE,
 	}
 
 	// numToMerge*eltsPerRun - merge的个数就是磁盘run的元素数
-	mergeSize := int(math.Ceil(float64(diskRunsPerLevel) * mergedFrac))
-	diskLevel := NewDiskLevel(pageSize, 1, uint64(numToMerge)*eltsPerRun, diskRunsPerLevel, mergeSize, bfFp)
-	lsm.diskLevels = append(lsm.diskLevels, diskLevel)
+	mergeSize := int(math.Ceil(float64(lsm.diskRunsPerLevel) * lsm.mergedFrac))
+	if opts.BlockCache != nil {
+		lsm.cacheID = opts.BlockCache.newID()
+	}
+	if opts.RowCacheSize > 0 {
+		lsm.rowCache = newLRUCache(int64(opts.RowCacheSize))
+	}
+	lsm.diskLevels = append(lsm.diskLevels, lsm.newDiskLevel(1, uint64(numToMerge)*lsm.eltsPerRun, mergeSize))
 
-	for i := 0; i < numRuns; i++ {
-		run := NewMemRun(math.MinInt32, math.MaxInt32)
-		run.SetSize(eltsPerRun)
+	lsm.recover()
+	lsm.tuneFilters()
+
+	for i := 0; i < lsm.numRuns; i++ {
+		run := NewMemRun()
+		run.SetSize(lsm.eltsPerRun)
 		lsm.C0 = append(lsm.C0, run)
 
-		bf := NewBloomFilter(eltsPerRun, bfFp)
+		bf := newFilterWithHash(lsm.opts.MemFilterType, lsm.eltsPerRun, lsm.c0FalsePositiveRate(), lsm.opts.Hasher, lsm.opts.HashSeed)
 		lsm.filters = append(lsm.filters, bf)
 	}
+	lsm.sched = newCompactionScheduler(lsm, opts.CompactionWorkers)
 	return lsm
 }
 
+// recover 按manifest恢复磁盘层，并删除manifest没有引用的run文件(合并到一半崩溃留下的)。
+// 只删除编号小于manifest中文件编号上界的run文件；目录中原来没有manifest时不清理，避免删除不属于LSM的文件
+func (lsm *LSM) recover() {
+	lsm.manifest = OpenManifest(lsm.dir)
+	for _, level := range lsm.manifest.Levels() {
+		for len(lsm.diskLevels) < level {
+			lsm.addDiskLevel()
+		}
+		for _, meta := range lsm.manifest.Runs(level) {
+			lsm.diskLevels[level-1].restoreRun(meta)
+		}
+	}
+
+	if lsm.manifest.created {
+		return
+	}
+	entries, err := os.ReadDir(lsm.dir)
+	if err != nil {
+		panic(err)
+	}
+	live, limit := lsm.manifest.LiveFiles(), lsm.manifest.LogFileNum()
+	for _, e := range entries {
+		fileNum, ok := parseRunFileName(e.Name())
+		if !ok || fileNum >= limit || live[fileNum] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(lsm.dir, e.Name())); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// addDiskLevel 在最下面增加一层
+func (lsm *LSM) addDiskLevel() {
+	lastLevel := lsm.diskLevels[len(lsm.diskLevels)-1]
+	mergeSize := math.Ceil(float64(lsm.diskRunsPerLevel) * lsm.mergedFrac) // 需要合并的run个数
+	runSize := lastLevel.runSize * uint64(lastLevel.mergeSize)
+	lsm.diskLevels = append(lsm.diskLevels, lsm.newDiskLevel(len(lsm.diskLevels)+1, runSize, int(mergeSize)))
+	lsm.tuneFilters()
+}
+
+func (lsm *LSM) c0FalsePositiveRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&lsm.bfFalsePositiveRate))
+}
+
+// @param level - 第几层(从1开始)
+func (lsm *LSM) newDiskLevel(level int, runSize uint64, mergeSize int) *DiskLevel {
+	dl := NewDiskLevel(lsm.dir, lsm.pageSize, level, runSize, lsm.diskRunsPerLevel, mergeSize, lsm.opts.BloomFalsePositiveRate, lsm.opts.runFormat(level))
+	dl.lazyFilter = lsm.opts.LazyLoadFilter
+	dl.limiter, dl.limitReads = lsm.opts.RateLimiter, lsm.opts.RateLimitReads
+	if lsm.opts.BlockCache != nil {
+		dl.SetBlockCache(lsm.opts.BlockCache, lsm.cacheID)
+	}
+	return dl
+}
+
 func (lsm *LSM) InsertKey(key int, value int) {
+	if lsm.rowCache != nil {
+		lsm.rowCache.Delete(key)
+	}
+	if d := atomic.LoadInt64(&lsm.writeDelay); d > 0 {
+		lsm.delayWrite(time.Duration(d))
+	}
+
 	if lsm.C0[lsm.activeRun].GetElementsNum() >= lsm.eltsPerRun {
 		lsm.activeRun++
 	}
@@ -79,8 +194,17 @@ func (lsm *LSM) InsertKey(key int, value int) {
 		lsm.doMerge()
 	}
 
-	lsm.C0[lsm.activeRun].InsertKey(KVPair{key, value})
-	lsm.filters[lsm.activeRun].Add(encodeInt(key))
+	run, filter := lsm.C0[lsm.activeRun], lsm.filters[lsm.activeRun]
+	if _, ok := filter.(*CuckooFilter); ok {
+		// 布谷鸟过滤器重复加入同一个key会占用多个槽，已在run中的key不再加入
+		if _, found := run.Lookup(key); found {
+			filter = nil
+		}
+	}
+	run.InsertKey(KVPair{key, value})
+	if filter != nil {
+		filter.Add(encodeInt(key))
+	}
 }
 
 func (lsm *LSM) doMerge() {
@@ -90,12 +214,17 @@ func (lsm *LSM) doMerge() {
 
 	// 合并
 	mergeRuns := append([]Run{}, lsm.C0[:lsm.numToMerge]...)
-	mergeFilters := append([]*BloomFilter{}, lsm.filters[:lsm.numToMerge]...)
-	lsm.mergeWg.Wait()
+	mergeFilters := append([]Filter{}, lsm.filters[:lsm.numToMerge]...)
+	var bytes uint64
+	for _, r := range mergeRuns {
+		bytes += r.GetElementsNum() * kvSize
+	}
+	// 停止写入时在这里等待，之后不再等上一次合并完成
+	f := lsm.sched.enqueueFlush(bytes)
 	lsm.mergeWg.Add(1)
-	go func(runs []Run, bf []*BloomFilter) {
+	go func(runs []Run, bf []Filter) {
 		defer lsm.mergeWg.Done()
-		lsm.mergeRuns(runs, bf)
+		lsm.mergeRuns(f, runs, bf)
 	}(mergeRuns, mergeFilters)
 
 	// 未合并的run前移
@@ -109,54 +238,101 @@ func (lsm *LSM) doMerge() {
 
 	// 补充空run
 	for i := lsm.activeRun; i < lsm.numRuns; i++ {
-		run := NewMemRun(math.MinInt32, math.MaxInt32)
+		run := NewMemRun()
 		run.SetSize(lsm.eltsPerRun)
 		lsm.C0 = append(lsm.C0, run)
 
-		bf := NewBloomFilter(lsm.eltsPerRun, lsm.bfFalsePositiveRate)
+		bf := newFilterWithHash(lsm.opts.MemFilterType, lsm.eltsPerRun, lsm.c0FalsePositiveRate(), lsm.opts.Hasher, lsm.opts.HashSeed)
 		lsm.filters = append(lsm.filters, bf)
 	}
 }
 
-func (lsm *LSM) mergeRuns(runsToMerge []Run, bfToMerge []*BloomFilter) {
+// mergeRuns 合并内存run，交给后台合并的调度器按排队的顺序写入第1层，返回时已经写入磁盘
+func (lsm *LSM) mergeRuns(f *compaction, runsToMerge []Run, bfToMerge []Filter) {
 	toMerge := make([]KVPair, 0, lsm.eltsPerRun*uint64(lsm.numToMerge))
-	for i := 0; i < len(runsToMerge); i++ {
-		all := runsToMerge[i].GetAll()
-		toMerge = append(toMerge, all...)
+	if sorted, ok := disjointMemRuns(runsToMerge); ok {
+		// key范围不重叠(例如顺序写入的key)，按key顺序拼接即可
+		for _, r := range sorted {
+			toMerge = append(toMerge, r.GetAll()...)
+		}
+	} else {
+		// 每个run已经按key排好序，多路归并，相同key中后面的run是新写入的，只保留它
+		all := make([][]KVPair, len(runsToMerge))
+		for i, r := range runsToMerge {
+			all[i] = r.GetAll()
+		}
+		toMerge = MergeSorted(all)
+	}
+	lsm.sched.flush(f, toMerge)
+}
+
+// disjointMemRuns 内存run的key范围两两不重叠时返回按key排序的非空run
+func disjointMemRuns(runs []Run) ([]Run, bool) {
+	sorted := make([]Run, 0, len(runs))
+	for _, r := range runs {
+		if r.GetElementsNum() > 0 {
+			sorted = append(sorted, r)
+		}
 	}
-	// ????? sort? 有序合并
-	sort.Slice(toMerge, func(i, j int) bool {
-		return toMerge[i].Key < toMerge[j].Key
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].GetMin() < sorted[j].GetMin()
 	})
-	if lsm.diskLevels[0].LevelFull() {
-		lsm.mergeRunsToLevel(1)
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].GetMax() >= sorted[i].GetMin() {
+			return nil, false
+		}
 	}
-	lsm.diskLevels[0].AddRunByArray(toMerge)
+	return sorted, true
 }
 
-// @param level - 要合并到的层索引
-func (lsm *LSM) mergeRunsToLevel(level int) {
-	if level == len(lsm.diskLevels) { // if this is the last level
-		lastLevel := lsm.diskLevels[level-1]
-		mergeSize := math.Ceil(float64(lsm.diskRunsPerLevel) * lsm.mergedFrac) // 需要合并的run个数
-		runSize := lastLevel.runSize * uint64(lastLevel.mergeSize)
-		newLevel := NewDiskLevel(lsm.pageSize, level+1, runSize, lsm.diskRunsPerLevel, int(mergeSize), lsm.bfFalsePositiveRate)
-		lsm.diskLevels = append(lsm.diskLevels, newLevel)
-	}
+// moveRunsDown 把上一层的runsToMerge合并或直接移动到下标为level的层，必须持有diskMu的写锁
+// @return 新写入的kv个数
+func (lsm *LSM) moveRunsDown(level int, runsToMerge []*DiskRun) uint64 {
+	c := lsm.planMerge(level, runsToMerge, nil)
+	lsm.runCompaction(c)
+	return lsm.installCompaction(c)
+}
 
-	if lsm.diskLevels[level].LevelFull() {
-		lsm.mergeRunsToLevel(level + 1) // merge down one, recursively
+// logMerge 把一次合并写入manifest，之后删除被合并和被替换的文件，移动的文件保留
+// @param added - 写入dl的新文件
+// @param moved - 从src移到dl的文件
+// @param merged - src中被合并掉的文件(包括moved)
+// @param replaced - dl中被替换掉的文件
+// @return 新写入的kv个数
+func (lsm *LSM) logMerge(src, dl *DiskLevel, added, moved, merged, replaced []*DiskRun) uint64 {
+	var written uint64
+	var edit VersionEdit
+	for _, run := range added {
+		edit.AddRun(dl.level, run.fileNum, run.GetCapacity())
+		written += run.GetCapacity()
 	}
-
-	var isLast = false
-	if level+1 == len(lsm.diskLevels) && lsm.diskLevels[level].LevelEmpty() {
-		isLast = true
+	for _, run := range moved {
+		edit.AddRun(dl.level, run.fileNum, run.GetCapacity())
+	}
+	for _, r := range merged {
+		edit.DeleteRun(src.level, r.fileNum)
+	}
+	for _, r := range replaced {
+		edit.DeleteRun(dl.level, r.fileNum)
+	}
+	if len(added) > 0 {
+		// 新文件的目录项先落盘，否则崩溃后manifest可能引用一个不存在的文件
+		if err := syncDir(lsm.dir); err != nil {
+			panic(err)
+		}
 	}
+	lsm.manifest.LogAndApply(&edit)
 
-	runsToMerge := lsm.diskLevels[level-1].GetRunsToMerge()
-	runLen := lsm.diskLevels[level-1].runSize
-	lsm.diskLevels[level].AddRuns(runsToMerge, runLen, isLast)
-	lsm.diskLevels[level-1].FreeMergedRuns()
+	if moved == nil {
+		for _, r := range merged {
+			r.Remove()
+		}
+	}
+	for _, r := range replaced {
+		r.Remove()
+	}
+	lsm.tuneFilters() // 各层的大小变了
+	return written
 }
 
 func (lsm *LSM) Lookup(key int) (int, bool) {
@@ -174,11 +350,35 @@ func (lsm *LSM) Lookup(key int) (int, bool) {
 		}
 	}
 
+	// 行缓存
+	if lsm.rowCache != nil {
+		if v, ok := lsm.rowCache.Get(key); ok {
+			e := v.(rowEntry)
+			return e.value, e.found
+		}
+	}
+
 	// 磁盘中找
 	// make sure that there isn't a merge happening as you search the disk
 	lsm.mergeWg.Wait()
 
 	// it's not in C_0 so let's look at disk.
+	lsm.diskMu.RLock()
+	value, found := lsm.lookupDisk(key)
+	lsm.diskMu.RUnlock()
+	if lsm.rowCache != nil {
+		lsm.rowCache.Set(key, rowEntry{value: value, found: found}, 1)
+	}
+	return value, found
+}
+
+// rowEntry 行缓存的值，不存在的key也缓存
+type rowEntry struct {
+	value int
+	found bool
+}
+
+func (lsm *LSM) lookupDisk(key int) (int, bool) {
 	for _, l := range lsm.diskLevels {
 		value, found := l.Lookup(key)
 		if found {
@@ -188,6 +388,37 @@ func (lsm *LSM) Lookup(key int) (int, bool) {
 	return 0, false
 }
 
+// RowCacheStats 返回行缓存的命中统计，没有开启行缓存时返回零值
+func (lsm *LSM) RowCacheStats() CacheStats {
+	var s CacheStats
+	if lsm.rowCache != nil {
+		s.add(lsm.rowCache)
+	}
+	return s
+}
+
+// BloomStats 返回各层布隆过滤器的估计统计，下标0是内存run，之后依次是各磁盘层。
+// 只统计BloomFilterType的过滤器；LazyLoadFilter时还没加载的过滤器不统计，也不因此加载
+func (lsm *LSM) BloomStats() []BloomStats {
+	stats := make([]BloomStats, 1, len(lsm.diskLevels)+1)
+	for i := 0; i <= lsm.activeRun; i++ {
+		stats[0].add(lsm.filters[i])
+	}
+	lsm.mergeWg.Wait()
+	lsm.diskMu.RLock()
+	defer lsm.diskMu.RUnlock()
+	for _, dl := range lsm.diskLevels {
+		var s BloomStats
+		for _, r := range dl.runs {
+			if f := r.loadedFilter(); f != nil {
+				s.add(f)
+			}
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
 func (lsm *LSM) DeleteKey(key int) {
 	lsm.InsertKey(key, lsm.V_TOMBSTONE)
 }
@@ -213,11 +444,11 @@ func (lsm *LSM) Range(key1, key2 int) []KVPair {
 
 	// 磁盘
 	lsm.mergeWg.Wait()
+	lsm.diskMu.RLock()
+	defer lsm.diskMu.RUnlock()
 	for _, l := range lsm.diskLevels {
-		for r := l.activeRun - 1; r >= 0; r-- {
-			var i1, i2 = l.runs[r].Range(key1, key2)
-			for m := i1; m < i2; m++ {
-				KV := l.runs[r].data[m]
+		for r := len(l.runs) - 1; r >= 0; r-- {
+			for _, KV := range l.runs[r].GetAllInRange(key1, key2) {
 				if _, ok := ht[KV.Key]; !ok && KV.Value != int(lsm.V_TOMBSTONE) {
 					etlsInRange = append(etlsInRange, KV)
 				}
@@ -228,21 +459,19 @@ func (lsm *LSM) Range(key1, key2 int) []KVPair {
 	return etlsInRange
 }
 
+// Close 等待后台的合并结束后关闭
 func (lsm *LSM) Close() {
+	lsm.compactWg.Wait()
 	lsm.mergeWg.Wait()
+	lsm.sched.close()
+	for _, l := range lsm.diskLevels {
+		l.Close()
+	}
+	lsm.manifest.Close()
 }
 
 func encodeInt(i int) []byte {
-	data := unsafe.Pointer(&i)
-	sz := int(unsafe.Sizeof(i))
-	t := reflect.SliceHeader{
-		Data: uintptr(data),
-		Len:  sz,
-		Cap:  sz,
-	}
-
-	d := *(*[]byte)(unsafe.Pointer(&t))
-	return d
+	return unsafe.Slice((*byte)(unsafe.Pointer(&i)), unsafe.Sizeof(i))
 }
 
 func (lsm *LSM) numBuffer() uint64 {
@@ -258,16 +487,47 @@ func (lsm *LSM) PrintStats() {
 	fmt.Printf("Number of Elements: %v\n", len(lsm.Range(lsm.V_TOMBSTONE, math.MaxInt64)))
 	fmt.Printf("Number of Elements in Buffer (including deletes): %v\n", lsm.numBuffer())
 
+	lsm.diskMu.RLock()
 	for i := 0; i < len(lsm.diskLevels); i++ {
-		fmt.Printf("Number of Elements in Disk Level %v(including deletes): %v\n",
-			i, lsm.diskLevels[i].GetElementsNum())
+		fmt.Printf("Number of Elements in Disk Level %v(including deletes): %v, deletes: %v\n",
+			i, lsm.diskLevels[i].GetElementsNum(), lsm.diskLevels[i].GetTombstonesNum())
+	}
+	lsm.diskMu.RUnlock()
+	if lsm.opts.BloomMemoryBudget > 0 {
+		fmt.Printf("Bloom Filter False Positive Rates (buffer, disk levels): %v\n", lsm.FalsePositiveRates())
+	}
+	for i, st := range lsm.BloomStats() {
+		if st.Filters == 0 {
+			continue
+		}
+		fmt.Printf("Bloom Filters of Level %v (0 is buffer): %v filters, estimated %v keys, estimated false positive rate %.5f\n",
+			i, st.Filters, st.EstimatedCount, st.FalsePositiveRate)
+	}
+	if c := lsm.opts.BlockCache; c != nil {
+		st := c.Stats()
+		fmt.Printf("Block Cache: hits %v, misses %v, hit rate %.3f, %v/%v bytes\n",
+			st.Hits, st.Misses, st.HitRate(), st.Size, st.Capacity)
+	}
+	if lsm.rowCache != nil {
+		st := lsm.RowCacheStats()
+		fmt.Printf("Row Cache: hits %v, misses %v, hit rate %.3f, %v/%v entries\n",
+			st.Hits, st.Misses, st.HitRate(), st.Entries, st.Capacity)
+	}
+	if rl := lsm.opts.RateLimiter; rl != nil {
+		st := rl.Stats()
+		fmt.Printf("Rate Limiter: %v bytes/s, %v bytes, throttled %v\n", st.Rate, st.Bytes, st.ThrottledTime)
 	}
+	st := lsm.WriteStall()
+	fmt.Printf("Write Stall: %v, pending merge bytes %v, runs in disk level 0 %v, delay per write %v\n",
+		st.Condition, st.PendingBytes, st.Level0Runs, st.Delay)
 	fmt.Println("KEY VALUE DUMP BY LEVEL: ")
 	lsm.printElts()
 }
 
 func (lsm *LSM) printElts() {
 	lsm.mergeWg.Wait()
+	lsm.diskMu.RLock()
+	defer lsm.diskMu.RUnlock()
 
 	fmt.Println("MEMORY BUFFER")
 	for i := 0; i <= lsm.activeRun; i++ {
@@ -283,11 +543,10 @@ func (lsm *LSM) printElts() {
 
 	for i, l := range lsm.diskLevels {
 		fmt.Printf("DISK LEVEL %v\n", i)
-		for j := 0; j < lsm.diskLevels[i].activeRun; j++ {
+		for j := 0; j < len(lsm.diskLevels[i].runs); j++ {
 			fmt.Printf("RUN %v\n", j)
-			for k := uint64(0); k < l.runs[j].GetCapacity(); k++ {
-				fmt.Printf("%v:%v  ",
-					l.runs[j].data[k].Key, lsm.diskLevels[i].runs[j].data[k].Value)
+			for it := l.runs[j].NewIterator(); it.Valid(); it.Next() {
+				fmt.Printf("%v:%v  ", it.Value().Key, it.Value().Value)
 			}
 			fmt.Println()
 		}
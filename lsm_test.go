@@ -0,0 +1,228 @@
+package slsm
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// lsmOp 一次写入，value为TOMBSTONE表示删除
+type lsmOp struct {
+	key, value int
+}
+
+// lsmModel 用map模拟LSM。内存run关闭时不落盘，记录最后一次合并内存run之前的写入个数，重新打开时只回放这些写入
+type lsmModel struct {
+	ops     []lsmOp
+	flushed int
+}
+
+func (m *lsmModel) state(n int) map[int]int {
+	kvs := make(map[int]int)
+	for _, op := range m.ops[:n] {
+		if op.value == TOMBSTONE {
+			delete(kvs, op.key)
+		} else {
+			kvs[op.key] = op.value
+		}
+	}
+	return kvs
+}
+
+// write 写入LSM并记录，MergedFrac为1时activeRun变小说明之前的写入都交给了后台合并
+func (m *lsmModel) write(lsm *LSM, op lsmOp) {
+	active := lsm.activeRun
+	if op.value == TOMBSTONE {
+		lsm.DeleteKey(op.key)
+	} else {
+		lsm.InsertKey(op.key, op.value)
+	}
+	if lsm.activeRun < active {
+		m.flushed = len(m.ops)
+	}
+	m.ops = append(m.ops, op)
+}
+
+func checkLSM(t *testing.T, lsm *LSM, kvs map[int]int, keySpace int, r *rand.Rand) {
+	t.Helper()
+	for k := 0; k < keySpace; k++ {
+		want, wantOK := kvs[k]
+		if v, ok := lsm.Lookup(k); ok != wantOK || v != want && ok {
+			t.Fatalf("lookup %v = %v, %v, want %v, %v", k, v, ok, want, wantOK)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		lo := r.Intn(keySpace)
+		hi := lo + r.Intn(keySpace/4)
+		got := lsm.Range(lo, hi)
+		sort.Slice(got, func(a, b int) bool { return got[a].Key < got[b].Key })
+		var want []KVPair
+		for k := lo; k < hi; k++ {
+			if v, ok := kvs[k]; ok {
+				want = append(want, KVPair{k, v})
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("range [%v, %v) got %v kvs, want %v", lo, hi, len(got), len(want))
+		}
+		for j := range got {
+			if got[j] != want[j] {
+				t.Fatalf("range [%v, %v) got %v, want %v", lo, hi, got[j], want[j])
+			}
+		}
+	}
+}
+
+func TestLSMAgainstMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    CompactionPolicy
+		partition uint64
+		dynamic   bool
+		filter    FilterType
+		memFilter FilterType
+		workers   int
+		tune      func(*Options)
+	}{
+		{name: "tiering", policy: TieringPolicy{}, filter: BloomFilterType},
+		{name: "tiering-blocked-workers", policy: TieringPolicy{}, filter: BlockedBloomFilterType, workers: 2},
+		{name: "leveling-xor", policy: LevelingPolicy{}, filter: XorFilterType},
+		{name: "leveling-partitioned", policy: LevelingPolicy{}, partition: 64, filter: BloomFilterType, workers: 2},
+		{name: "leveling-dynamic", policy: LevelingPolicy{}, dynamic: true, filter: BlockedBloomFilterType},
+		{name: "leveling-partitioned-dynamic-cuckoo", policy: LevelingPolicy{}, partition: 64, dynamic: true,
+			filter: CuckooFilterType, memFilter: CuckooFilterType, workers: 2},
+		{name: "lazy-leveling-xor", policy: LazyLevelingPolicy{}, filter: XorFilterType, memFilter: BlockedBloomFilterType},
+		{name: "lazy-leveling-partitioned-dynamic", policy: LazyLevelingPolicy{}, partition: 64, dynamic: true,
+			filter: BloomFilterType, workers: 2, tune: func(o *Options) {
+				o.TombstoneCompactionRatio = 0.3
+				o.BloomMemoryBudget = 8 << 10
+			}},
+		{name: "leveling-compressed-delta", policy: LevelingPolicy{}, filter: BloomFilterType, tune: func(o *Options) {
+			o.LevelCompression = []Compressor{nil, NewFlateCompressor(1)}
+			o.PageEncoding = DeltaEncoding
+			o.RangeFilterShift = 4
+			o.BlockCache = NewBlockCache(1 << 20)
+			o.RowCacheSize = 64
+		}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			o := DefaultOptions()
+			o.Dir = t.TempDir()
+			o.EltsPerRun = 32
+			o.NumRuns = 4
+			o.PageSize = 16
+			o.DiskRunsPerLevel = 4
+			o.CompactionPolicy = tt.policy
+			o.PartitionSize = tt.partition
+			o.DynamicLevelSizing = tt.dynamic
+			o.FilterType = tt.filter
+			o.MemFilterType = tt.memFilter
+			o.CompactionWorkers = tt.workers
+			if tt.tune != nil {
+				tt.tune(o)
+			}
+
+			const keySpace = 2000
+			r := rand.New(rand.NewSource(1))
+			var m lsmModel
+			lsm := NewLSMWithOptions(o)
+			for round := 0; round < 3; round++ {
+				for i := 0; i < 4000; i++ {
+					op := lsmOp{key: r.Intn(keySpace), value: r.Intn(1 << 30)}
+					if r.Intn(4) == 0 {
+						op.value = TOMBSTONE
+					}
+					m.write(lsm, op)
+				}
+				checkLSM(t, lsm, m.state(len(m.ops)), keySpace, r)
+
+				lsm.Close()
+				m.ops = m.ops[:m.flushed]
+				m.flushed = len(m.ops)
+				lsm = NewLSMWithOptions(o)
+				checkLSM(t, lsm, m.state(len(m.ops)), keySpace, r)
+			}
+			lsm.Close()
+		})
+	}
+}
+
+// loadedFilters 返回磁盘run中过滤器已经加载和还没加载的个数
+func loadedFilters(lsm *LSM) (loaded, lazy int) {
+	lsm.diskMu.RLock()
+	defer lsm.diskMu.RUnlock()
+	for _, l := range lsm.diskLevels {
+		for _, r := range l.runs {
+			if r.bfData != nil {
+				lazy++
+			} else {
+				loaded++
+			}
+		}
+	}
+	return loaded, lazy
+}
+
+func TestLazyLoadFilterReopen(t *testing.T) {
+	for _, ft := range []FilterType{BloomFilterType, BlockedBloomFilterType, XorFilterType, CuckooFilterType} {
+		o := DefaultOptions()
+		o.Dir = t.TempDir()
+		o.EltsPerRun = 64
+		o.NumRuns = 2
+		o.PageSize = 16
+		o.DiskRunsPerLevel = 4
+		o.FilterType = ft
+		o.LazyLoadFilter = true
+		lsm := NewLSMWithOptions(o)
+		for i := 0; i < 2000; i++ {
+			lsm.InsertKey(2*i, i)
+		}
+		lsm.Close()
+
+		lsm = NewLSMWithOptions(o)
+		if loaded, lazy := loadedFilters(lsm); loaded != 0 || lazy == 0 {
+			t.Fatalf("%v: %v filters loaded on open, %v lazy", ft, loaded, lazy)
+		}
+		// 多个goroutine同时第一次查找，过滤器只加载一次
+		done := make(chan struct{})
+		for g := 0; g < 4; g++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				for i := 0; i < 1024; i++ {
+					if v, ok := lsm.Lookup(2 * i); !ok || v != i {
+						t.Errorf("%v: lookup %v = %v, %v", ft, 2*i, v, ok)
+						return
+					}
+					if _, ok := lsm.Lookup(2*i + 1); ok {
+						t.Errorf("%v: lookup %v found", ft, 2*i+1)
+						return
+					}
+				}
+			}()
+		}
+		for g := 0; g < 4; g++ {
+			<-done
+		}
+		if loaded, _ := loadedFilters(lsm); loaded == 0 {
+			t.Fatalf("%v: no filter loaded by lookups", ft)
+		}
+
+		// 延迟加载的run继续参与合并
+		for i := 2000; i < 4000; i++ {
+			lsm.InsertKey(2*i, i)
+		}
+		lsm.Close()
+		lsm = NewLSMWithOptions(o)
+		for i := 0; i < 3840; i++ {
+			if i >= 1920 && i < 2000 {
+				continue // 第一次关闭时还在内存run中
+			}
+			if v, ok := lsm.Lookup(2 * i); !ok || v != i {
+				t.Fatalf("%v: lookup %v = %v, %v after reopen", ft, 2*i, v, ok)
+			}
+		}
+		lsm.Close()
+	}
+}
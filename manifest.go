@@ -0,0 +1,332 @@
+package slsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	manifestName    = "MANIFEST"
+	manifestTmpName = "MANIFEST.tmp"
+
+	// fileNumBatch 每次在manifest中预留的文件编号个数，分配的编号总是小于已持久化的编号上界
+	fileNumBatch = 64
+)
+
+// VersionEdit中各字段的标签
+const (
+	tagNextFileNum = 1
+	tagNewRun      = 2
+	tagDeletedRun  = 3
+)
+
+var errCorruptEdit = errors.New("slsm: corrupt manifest edit")
+
+// runMeta 磁盘run的元数据
+type runMeta struct {
+	level   int    // 所在层
+	fileNum uint64 // 文件编号
+	count   uint64 // kv个数
+}
+
+// VersionEdit 一次原子的元数据变更：新增的run和删除的run作为一个整体写入manifest
+type VersionEdit struct {
+	nextFileNum uint64
+	newRuns     []runMeta
+	deletedRuns []runMeta
+}
+
+// AddRun 记录新增run
+func (ve *VersionEdit) AddRun(level int, fileNum uint64, count uint64) {
+	ve.newRuns = append(ve.newRuns, runMeta{level: level, fileNum: fileNum, count: count})
+}
+
+// DeleteRun 记录删除run
+func (ve *VersionEdit) DeleteRun(level int, fileNum uint64) {
+	ve.deletedRuns = append(ve.deletedRuns, runMeta{level: level, fileNum: fileNum})
+}
+
+func (ve *VersionEdit) encode() []byte {
+	b := make([]byte, 0, 64)
+	b = appendUvarint(b, tagNextFileNum)
+	b = appendUvarint(b, ve.nextFileNum)
+	for _, r := range ve.deletedRuns {
+		b = appendUvarint(b, tagDeletedRun)
+		b = appendUvarint(b, uint64(r.level))
+		b = appendUvarint(b, r.fileNum)
+	}
+	for _, r := range ve.newRuns {
+		b = appendUvarint(b, tagNewRun)
+		b = appendUvarint(b, uint64(r.level))
+		b = appendUvarint(b, r.fileNum)
+		b = appendUvarint(b, r.count)
+	}
+	return b
+}
+
+func (ve *VersionEdit) decode(b []byte) error {
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, errCorruptEdit
+		}
+		b = b[n:]
+		return v, nil
+	}
+	for len(b) > 0 {
+		tag, err := next()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case tagNextFileNum:
+			if ve.nextFileNum, err = next(); err != nil {
+				return err
+			}
+		case tagNewRun, tagDeletedRun:
+			var r runMeta
+			level, err := next()
+			if err != nil {
+				return err
+			}
+			r.level = int(level)
+			if r.fileNum, err = next(); err != nil {
+				return err
+			}
+			if tag == tagDeletedRun {
+				ve.deletedRuns = append(ve.deletedRuns, r)
+				continue
+			}
+			if r.count, err = next(); err != nil {
+				return err
+			}
+			ve.newRuns = append(ve.newRuns, r)
+		default:
+			return errCorruptEdit
+		}
+	}
+	return nil
+}
+
+// Manifest 记录每层有哪些run。
+// 每次合并的结果以一条VersionEdit追加写入并fsync，保证崩溃后看到的要么是合并前、要么是合并后的状态。
+// 记录格式: crc32(4字节) | 长度(4字节) | VersionEdit
+type Manifest struct {
+	dir         string
+	fd          *os.File
+	mu          sync.Mutex        // 保护fd和文件编号，后台合并并发分配文件编号
+	nextFileNum uint64            // 下一个分配的文件编号
+	logFileNum  uint64            // 已写入manifest的文件编号上界，崩溃后从这里继续分配
+	created     bool              // 打开时目录中还没有manifest
+	levels      map[int][]runMeta // 层 -> 按新旧顺序排列的run
+}
+
+// OpenManifest 打开目录下的manifest，回放所有edit并重写为一个快照
+func OpenManifest(dir string) *Manifest {
+	m := &Manifest{
+		dir:        dir,
+		logFileNum: 1,
+		levels:     make(map[int][]runMeta),
+	}
+	if err := m.replay(); err != nil {
+		panic(err)
+	}
+	m.nextFileNum = m.logFileNum
+	if err := m.writeSnapshot(); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (m *Manifest) replay() error {
+	data, err := os.ReadFile(filepath.Join(m.dir, manifestName))
+	if os.IsNotExist(err) {
+		m.created = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for len(data) >= 8 {
+		crc := binary.LittleEndian.Uint32(data)
+		n := binary.LittleEndian.Uint32(data[4:])
+		if uint64(len(data)-8) < uint64(n) {
+			break // 写了一半的edit，丢弃
+		}
+		payload := data[8 : 8+n]
+		if crc32.ChecksumIEEE(payload) != crc {
+			break
+		}
+		var ve VersionEdit
+		if err := ve.decode(payload); err != nil {
+			return err
+		}
+		m.apply(&ve)
+		data = data[8+n:]
+	}
+	return nil
+}
+
+func (m *Manifest) apply(ve *VersionEdit) {
+	if ve.nextFileNum > m.logFileNum {
+		m.logFileNum = ve.nextFileNum
+	}
+	for _, d := range ve.deletedRuns {
+		runs := m.levels[d.level]
+		for i := range runs {
+			if runs[i].fileNum == d.fileNum {
+				runs = append(runs[:i], runs[i+1:]...)
+				break
+			}
+		}
+		m.levels[d.level] = runs
+	}
+	for _, r := range ve.newRuns {
+		m.levels[r.level] = append(m.levels[r.level], r)
+		if r.fileNum >= m.logFileNum {
+			m.logFileNum = r.fileNum + 1
+		}
+	}
+}
+
+// writeSnapshot 把当前状态写成新的manifest，通过rename原子替换旧文件
+func (m *Manifest) writeSnapshot() error {
+	var ve VersionEdit
+	ve.nextFileNum = m.logFileNum
+	for _, level := range m.Levels() {
+		ve.newRuns = append(ve.newRuns, m.levels[level]...)
+	}
+
+	tmp := filepath.Join(m.dir, manifestTmpName)
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeEdit(fd, &ve); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(m.dir, manifestName)); err != nil {
+		return err
+	}
+	if err := syncDir(m.dir); err != nil {
+		return err
+	}
+
+	m.fd, err = os.OpenFile(filepath.Join(m.dir, manifestName), os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func writeEdit(fd *os.File, ve *VersionEdit) error {
+	payload := ve.encode()
+	rec := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(rec, crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(payload)))
+	rec = append(rec, payload...)
+	if _, err := fd.Write(rec); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
+
+// NewFileNum 分配一个新的文件编号，后台合并写文件时并发调用。
+// 用完预留的编号时先在manifest中记录新的上界，崩溃后残留的文件编号总是小于manifest中的上界
+func (m *Manifest) NewFileNum() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.nextFileNum >= m.logFileNum {
+		ve := VersionEdit{nextFileNum: m.nextFileNum + fileNumBatch}
+		if err := writeEdit(m.fd, &ve); err != nil {
+			panic(fmt.Errorf("write manifest err[%v]", err))
+		}
+		m.apply(&ve)
+	}
+	m.nextFileNum++
+	return m.nextFileNum - 1
+}
+
+// LogFileNum 返回manifest中记录的文件编号上界，所有分配过的编号都小于它
+func (m *Manifest) LogFileNum() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.logFileNum
+}
+
+// LogAndApply 持久化edit后再应用到内存状态。返回后edit中删除的文件才可以被删除
+func (m *Manifest) LogAndApply(ve *VersionEdit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ve.nextFileNum = m.logFileNum
+	if err := writeEdit(m.fd, ve); err != nil {
+		panic(fmt.Errorf("write manifest err[%v]", err))
+	}
+	m.apply(ve)
+}
+
+// Levels 返回有run的层，从小到大
+func (m *Manifest) Levels() []int {
+	levels := make([]int, 0, len(m.levels))
+	for level, runs := range m.levels {
+		if len(runs) > 0 {
+			levels = append(levels, level)
+		}
+	}
+	sort.Ints(levels)
+	return levels
+}
+
+// Runs 返回某层的run
+func (m *Manifest) Runs(level int) []runMeta {
+	return m.levels[level]
+}
+
+// LiveFiles 返回manifest中引用的所有文件编号
+func (m *Manifest) LiveFiles() map[uint64]bool {
+	live := make(map[uint64]bool)
+	for _, runs := range m.levels {
+		for _, r := range runs {
+			live[r.fileNum] = true
+		}
+	}
+	return live
+}
+
+func (m *Manifest) Close() {
+	if m.fd == nil {
+		return
+	}
+	if err := m.fd.Close(); err != nil {
+		panic(err)
+	}
+	m.fd = nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarint(b []byte, v int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], int64(v))
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,142 @@
+package slsm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestReplay(t *testing.T) {
+	dir := t.TempDir()
+	m := OpenManifest(dir)
+	var ve VersionEdit
+	ve.AddRun(1, m.NewFileNum(), 10)
+	ve.AddRun(1, m.NewFileNum(), 20)
+	m.LogAndApply(&ve)
+	ve = VersionEdit{}
+	ve.DeleteRun(1, 1)
+	ve.AddRun(2, 1, 10) // 移动到下一层
+	ve.AddRun(2, m.NewFileNum(), 30)
+	m.LogAndApply(&ve)
+	m.Close()
+
+	m = OpenManifest(dir)
+	defer m.Close()
+	if levels := m.Levels(); len(levels) != 2 || levels[0] != 1 || levels[1] != 2 {
+		t.Fatalf("levels %v", levels)
+	}
+	if runs := m.Runs(1); len(runs) != 1 || runs[0].fileNum != 2 || runs[0].count != 20 {
+		t.Fatalf("level 1 runs %v", runs)
+	}
+	if runs := m.Runs(2); len(runs) != 2 || runs[0].fileNum != 1 || runs[1].fileNum != 3 {
+		t.Fatalf("level 2 runs %v", runs)
+	}
+	// 预留的编号可能跳过一些，但不能重复使用已经分配过的编号
+	if n := m.NewFileNum(); n < 4 {
+		t.Fatalf("next file num %v", n)
+	}
+}
+
+func TestManifestTruncatedEdit(t *testing.T) {
+	for _, corrupt := range []string{"truncated", "checksum"} {
+		dir := t.TempDir()
+		m := OpenManifest(dir)
+		var ve VersionEdit
+		ve.AddRun(1, m.NewFileNum(), 10)
+		m.LogAndApply(&ve)
+		m.Close()
+
+		// 模拟写最后一条edit时崩溃
+		ve = VersionEdit{nextFileNum: 3}
+		ve.DeleteRun(1, 1)
+		ve.AddRun(1, 2, 10)
+		payload := ve.encode()
+		rec := make([]byte, 8, 8+len(payload))
+		rec[4] = byte(len(payload))
+		rec = append(rec, payload...)
+		if corrupt == "truncated" {
+			rec = rec[:len(rec)-1]
+		}
+		fd, err := os.OpenFile(filepath.Join(dir, manifestName), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+		fd.Close()
+
+		m = OpenManifest(dir)
+		if runs := m.Runs(1); len(runs) != 1 || runs[0].fileNum != 1 {
+			t.Fatalf("%v: runs %v", corrupt, runs)
+		}
+		m.Close()
+	}
+}
+
+func TestRecoverRemovesLeftoverFiles(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 64
+	o.NumRuns = 2
+	o.PageSize = 16
+	lsm := NewLSMWithOptions(o)
+	for i := 0; i < 1000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	// 合并写了一半崩溃留下的文件
+	leftover := runFileName(o.Dir, lsm.manifest.NewFileNum())
+	if err := os.WriteFile(leftover, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lsm.Close()
+
+	lsm = NewLSMWithOptions(o)
+	defer lsm.Close()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("leftover file not removed: %v", err)
+	}
+	// 内存run关闭时不落盘，只检查已经合并到磁盘的key
+	for i := 0; i < 512; i++ {
+		if v, ok := lsm.Lookup(i); !ok || v != i {
+			t.Fatalf("lookup %v = %v, %v", i, v, ok)
+		}
+	}
+}
+
+func TestRecoverKeepsOtherFiles(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 64
+	o.NumRuns = 2
+	o.PageSize = 16
+
+	// 目录中没有manifest时不清理
+	foreign := []string{"7.run", "2024.run", "abc.run", "000005.run.bak", runFileName("", 3)}
+	for _, name := range foreign {
+		if err := os.WriteFile(filepath.Join(o.Dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lsm := NewLSMWithOptions(o)
+	for i := 0; i < 1000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	future := runFileName(o.Dir, lsm.manifest.LogFileNum()+100)
+	lsm.Close()
+	if err := os.WriteFile(future, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 有manifest时只删除编号小于manifest中上界的run文件
+	lsm = NewLSMWithOptions(o)
+	lsm.Close()
+	for _, name := range foreign[:4] {
+		if _, err := os.Stat(filepath.Join(o.Dir, name)); err != nil {
+			t.Fatalf("%v removed: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(future); err != nil {
+		t.Fatalf("%v removed: %v", future, err)
+	}
+}
@@ -0,0 +1,105 @@
+package slsm
+
+import "math"
+
+// monkeyMinFalsePositiveRate 分配的最小误判率，约29位每key。预算比各层需要的多时不再增加位数，
+// 否则误判率会下溢成0，过滤器按0误判率建不出来
+const monkeyMinFalsePositiveRate = 1e-6
+
+// monkeyFalsePositiveRates 按Monkey(Dayan et al., SIGMOD'17)的方法在各层之间分配布隆过滤器的内存。
+// 一次查找的期望I/O是各层探查的过滤器个数乘误判率之和 Σ w_i·p_i，在总位数固定时，
+// p_i = λ·n_i/w_i 最优，λ由 Σ n_i·ln(1/p_i)/ln2² = bits 求出。
+// p_i限制在[monkeyMinFalsePositiveRate, 1]之间：达到1的层不分配内存，达到下限的层用不完的内存留给其它层。
+// 用掉的位数随λ单调递减，二分求λ；所有层都达到下限时预算用不完
+// @param entries - 每层的元素个数
+// @param probes - 每层一次查找要探查的过滤器个数
+// @param bits - 布隆过滤器总位数
+func monkeyFalsePositiveRates(entries []uint64, probes []float64, bits float64) []float64 {
+	const ln2sq = 0.480453013918201 // ln(2)^2
+	fprs := make([]float64, len(entries))
+	// logRatio[i] = ln(n_i/w_i)，ln(p_i) = ln(λ) + logRatio[i]
+	logRatio := make([]float64, len(entries))
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i, n := range entries {
+		fprs[i] = 1
+		if n == 0 || probes[i] <= 0 {
+			continue
+		}
+		logRatio[i] = math.Log(float64(n) / probes[i])
+		lo = math.Min(lo, math.Log(monkeyMinFalsePositiveRate)-logRatio[i])
+		hi = math.Max(hi, -logRatio[i])
+	}
+	if math.IsInf(lo, 1) {
+		return fprs
+	}
+	used := func(logLambda float64) float64 {
+		var b float64
+		for i, n := range entries {
+			if n > 0 && probes[i] > 0 {
+				logP := math.Max(math.Log(monkeyMinFalsePositiveRate), math.Min(0, logLambda+logRatio[i]))
+				b -= float64(n) * logP / ln2sq
+			}
+		}
+		return b
+	}
+	// lo时所有层都在下限，hi时所有层都是1
+	if used(lo) > bits {
+		for j := 0; j < 200 && hi-lo > 1e-12; j++ {
+			mid := (lo + hi) / 2
+			if used(mid) > bits {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		lo = hi
+	}
+	for i, n := range entries {
+		if n == 0 || probes[i] <= 0 {
+			continue
+		}
+		if logP := lo + logRatio[i]; logP <= math.Log(monkeyMinFalsePositiveRate) {
+			fprs[i] = monkeyMinFalsePositiveRate
+		} else {
+			fprs[i] = math.Min(1, math.Exp(logP))
+		}
+	}
+	return fprs
+}
+
+// tuneFilters 按当前各磁盘层实际的元素个数和查找时探查的run个数重新分配误判率，只影响之后新建的布隆过滤器。
+// 内存run的误判只多一次内存查找，不计入I/O，仍然使用BloomFalsePositiveRate。
+// 空的层保留原来的误判率，给第一次写入的run使用。必须持有diskMu的写锁
+func (lsm *LSM) tuneFilters() {
+	if lsm.opts.BloomMemoryBudget <= 0 {
+		return
+	}
+	entries := make([]uint64, len(lsm.diskLevels))
+	probes := make([]float64, len(lsm.diskLevels))
+	for i, l := range lsm.diskLevels {
+		entries[i] = l.GetElementsNum()
+		probes[i] = float64(len(l.runs))
+		if lsm.partitioned(i) {
+			probes[i] = 1 // 分区的层只查key所在的文件
+		}
+	}
+	fprs := monkeyFalsePositiveRates(entries, probes, float64(lsm.opts.BloomMemoryBudget)*8)
+	for i, l := range lsm.diskLevels {
+		if entries[i] > 0 {
+			l.setFalsePositiveRate(fprs[i])
+		}
+	}
+}
+
+// FalsePositiveRates 返回当前每层使用的误判率，下标0是内存run，之后是各磁盘层
+func (lsm *LSM) FalsePositiveRates() []float64 {
+	lsm.mergeWg.Wait()
+	lsm.diskMu.RLock()
+	defer lsm.diskMu.RUnlock()
+	fprs := make([]float64, 0, len(lsm.diskLevels)+1)
+	fprs = append(fprs, lsm.c0FalsePositiveRate())
+	for _, l := range lsm.diskLevels {
+		fprs = append(fprs, l.falsePositiveRate())
+	}
+	return fprs
+}
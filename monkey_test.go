@@ -0,0 +1,93 @@
+package slsm
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMonkeyFalsePositiveRates(t *testing.T) {
+	const ln2sq = 0.480453013918201
+	entries := []uint64{1000, 10000, 0, 100000}
+	probes := []float64{4, 4, 0, 1}
+	bits := 10.0 * 111000
+	fprs := monkeyFalsePositiveRates(entries, probes, bits)
+	if fprs[2] != 1 {
+		t.Fatalf("empty level fpr %v", fprs[2])
+	}
+	var used float64
+	for i, n := range entries {
+		if n == 0 {
+			continue
+		}
+		used += float64(n) * math.Log(1/fprs[i]) / ln2sq
+		// 最优时 p_i·w_i/n_i 各层相同
+		r := fprs[i] * probes[i] / float64(n)
+		r0 := fprs[0] * probes[0] / float64(entries[0])
+		if math.Abs(r-r0) > 1e-9*r0 {
+			t.Fatalf("level %v not optimal: %v != %v", i, r, r0)
+		}
+	}
+	if math.Abs(used-bits) > 1e-6*bits {
+		t.Fatalf("used %v bits, budget %v", used, bits)
+	}
+
+	// 预算很小时，相对探查次数元素多的层不分配内存
+	fprs = monkeyFalsePositiveRates([]uint64{10, 1000000}, []float64{1, 1}, 100)
+	if fprs[1] != 1 || fprs[0] >= 1 {
+		t.Fatalf("small budget fprs %v", fprs)
+	}
+}
+
+func TestMonkeyGenerousBudget(t *testing.T) {
+	const ln2sq = 0.480453013918201
+	// 预算远大于需要时误判率停在下限，不会下溢成0
+	fprs := monkeyFalsePositiveRates([]uint64{16000}, []float64{1}, 8*(10<<20))
+	if fprs[0] != monkeyMinFalsePositiveRate {
+		t.Fatalf("fprs %v", fprs)
+	}
+
+	// 小的层达到下限，剩下的预算给大的层
+	entries := []uint64{10, 1000000}
+	probes := []float64{1, 1}
+	bits := 10*math.Log(1/monkeyMinFalsePositiveRate)/ln2sq + 1000000*5
+	fprs = monkeyFalsePositiveRates(entries, probes, bits)
+	if fprs[0] != monkeyMinFalsePositiveRate || fprs[1] <= monkeyMinFalsePositiveRate || fprs[1] >= 1 {
+		t.Fatalf("fprs %v", fprs)
+	}
+	var used float64
+	for i, n := range entries {
+		used += float64(n) * math.Log(1/fprs[i]) / ln2sq
+	}
+	if math.Abs(used-bits) > 1e-6*bits {
+		t.Fatalf("used %v bits, budget %v", used, bits)
+	}
+}
+
+func TestLSMGenerousBloomBudget(t *testing.T) {
+	for _, ft := range []FilterType{BloomFilterType, BlockedBloomFilterType} {
+		o := DefaultOptions()
+		o.Dir = t.TempDir()
+		o.FilterType = ft
+		o.BloomMemoryBudget = 10 << 20
+		lsm := NewLSMWithOptions(o)
+		for i := 0; i < 40000; i++ {
+			lsm.InsertKey(2*i, i)
+		}
+		fprs := lsm.FalsePositiveRates()
+		if fprs[1] != monkeyMinFalsePositiveRate {
+			t.Fatalf("%v: fprs %v", ft, fprs)
+		}
+		// 第1层按下限新建的过滤器仍然有效，第一个run按BloomFalsePositiveRate建，不检查
+		lsm.diskMu.RLock()
+		runs := lsm.diskLevels[0].runs
+		r := runs[len(runs)-1]
+		for i := 0; i < 40000; i++ {
+			if r.MayContain(2*i + 1) {
+				lsm.diskMu.RUnlock()
+				t.Fatalf("%v: filter of run %v passes absent key %v", ft, r.fileNum, 2*i+1)
+			}
+		}
+		lsm.diskMu.RUnlock()
+		lsm.Close()
+	}
+}
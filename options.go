@@ -0,0 +1,130 @@
+package slsm
+
+import "time"
+
+// Options LSM配置
+type Options struct {
+	Dir string // 数据目录
+
+	EltsPerRun             uint64  // 每个run的kv个数
+	NumRuns                int     // 内存run的个数
+	MergedFrac             float64 // 需要合并的比率(1.0代表所有run都满了才合并)
+	BloomFalsePositiveRate float64 // 布隆过滤器误判率
+	PageSize               uint32  // 磁盘页大小
+	DiskRunsPerLevel       int     // 每层磁盘run的个数
+
+	// 每层磁盘run的页压缩算法，下标0对应第1层，超出的层使用最后一个；nil表示不压缩。
+	// 上层run很快会被合并掉，一般只压缩下面几层。
+	// 没有用RegisterCompressor注册的压缩算法在打开时自动注册，ID已被另一种压缩算法占用时panic
+	LevelCompression []Compressor
+
+	PageEncoding    PageEncoding // 磁盘run的页内编码
+	RestartInterval int          // 差值编码时每隔多少个kv设置一个重启点
+
+	// 解码后的页缓存，可以在多个LSM之间共享；nil表示不缓存。
+	// 定长编码且不压缩的run直接读mmap，不经过缓存
+	BlockCache *BlockCache
+
+	// 行缓存最多缓存多少个key，在内存run之后、磁盘之前查找；0表示不开启
+	RowCacheSize int
+
+	// 打开时不加载磁盘run的过滤器，第一次查找该run时再加载
+	LazyLoadFilter bool
+
+	// 磁盘run的布隆过滤器的总字节数。大于0时按各层的实际大小分配误判率使期望的查找I/O最小(Monkey)，
+	// 内存run和还没有数据的层仍然使用BloomFalsePositiveRate。每层的误判率不低于1e-6，预算多于需要时用不完
+	BloomMemoryBudget int64
+
+	// 磁盘run使用的点查询过滤器
+	FilterType FilterType
+	// 内存run使用的点查询过滤器，不能是XorFilterType
+	MemFilterType FilterType
+
+	// 磁盘run的范围过滤器：把key右移这么多位作为前缀加入布隆过滤器，
+	// 短范围查询可以跳过没有对应前缀的run。0表示不使用
+	RangeFilterShift uint8
+
+	// 过滤器的hash函数，nil表示MurmurHash3。hash函数和种子记录在run文件中，
+	// 重新打开时使用写入时的hash函数，修改只影响新写入的run。
+	// 没有用RegisterHasher注册的hash函数在打开时自动注册，ID已被另一种hash函数占用时panic
+	Hasher Hasher
+	// 过滤器的hash种子，不同租户使用不同的种子可以避免构造出的key在所有LSM上都冲突
+	HashSeed uint32
+
+	// 合并策略，nil表示TieringPolicy
+	CompactionPolicy CompactionPolicy
+
+	// 分级的层拆分成多个key范围不重叠的文件，每个文件最多这么多个kv。
+	// 合并进来的数据只改写与它重叠的文件，放不下时也只把一部分文件合并到下一层。0表示不拆分
+	PartitionSize uint64
+
+	// 磁盘run中删除标记的比例达到这个值时，不管层是否已满都把它合并到下一层，
+	// 到最下面一层时丢弃删除标记。0表示不开启
+	TombstoneCompactionRatio float64
+
+	// 后台合并的goroutine个数，不同层或不重叠key范围的合并可以同时进行。0表示1个
+	CompactionWorkers int
+
+	// 写入限流：等待合并的字节数或第1层的run个数达到Slowdown*时每次写入延迟WriteDelay，
+	// 超过得越多延迟越长；达到Stop*时内存run写满后停止写入，直到后台合并跟上。0表示不限制。
+	// 没有设置StopPendingBytes时，内存run写满时还要等上一次内存run的合并完成，这个等待不算限流，不调用OnWriteStall
+	SlowdownPendingBytes uint64
+	StopPendingBytes     uint64
+	SlowdownLevel0Runs   int
+	StopLevel0Runs       int
+	WriteDelay           time.Duration // 0表示DefaultWriteDelay
+
+	// 限流状态变化时调用，可以用来减少请求。在写入或后台合并的goroutine中调用，不能调用LSM的方法
+	OnWriteStall func(WriteStallInfo)
+
+	// 限制后台合并写run文件的速度，可以在多个LSM之间共享，运行时用SetRate调整。nil表示不限速
+	RateLimiter *RateLimiter
+	// 合并读被合并的run也计入RateLimiter
+	RateLimitReads bool
+
+	// 动态层大小：最下面一层是分级的层时，各层的目标大小从最下面一层的实际大小往上按合并的run个数逐层缩小，
+	// 上面各层之和始终只是最下面一层的一小部分，空间放大有上界；数据增长或减少时相应地增加或删除层
+	DynamicLevelSizing bool
+}
+
+// DefaultOptions 返回默认配置
+func DefaultOptions() *Options {
+	return &Options{
+		Dir:                    ".",
+		EltsPerRun:             800,
+		NumRuns:                20,
+		MergedFrac:             1.0,
+		BloomFalsePositiveRate: 0.001,
+		PageSize:               1024,
+		DiskRunsPerLevel:       20,
+		RestartInterval:        DefaultRestartInterval,
+	}
+}
+
+// compressor 返回第level层(从1开始)的压缩算法
+func (o *Options) compressor(level int) Compressor {
+	if len(o.LevelCompression) == 0 {
+		return nil
+	}
+	if level > len(o.LevelCompression) {
+		level = len(o.LevelCompression)
+	}
+	return o.LevelCompression[level-1]
+}
+
+// runFormat 返回第level层(从1开始)的run文件格式
+func (o *Options) runFormat(level int) RunFormat {
+	restart := o.RestartInterval
+	if restart <= 0 {
+		restart = DefaultRestartInterval
+	}
+	return RunFormat{
+		Compressor:      o.compressor(level),
+		Encoding:        o.PageEncoding,
+		RestartInterval: restart,
+		Filter:          o.FilterType,
+		RangeShift:      o.RangeFilterShift,
+		Hasher:          o.Hasher,
+		HashSeed:        o.HashSeed,
+	}
+}
@@ -0,0 +1,171 @@
+package slsm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PageEncoding 页内kv的编码方式，写入run文件
+type PageEncoding uint8
+
+const (
+	// RawEncoding 定长编码，每个kv 16字节
+	RawEncoding PageEncoding = 0
+	// DeltaEncoding 页内key递增，重启点处存完整key，其余只存与前一个key的差值(varint)。
+	// 页尾记录每个重启点的偏移，页内查找时先二分重启点再顺序解码
+	DeltaEncoding PageEncoding = 1
+)
+
+// DefaultRestartInterval 默认每隔多少个kv设置一个重启点
+const DefaultRestartInterval = 16
+
+var errCorruptPage = errors.New("slsm: corrupt page")
+
+// encodeRawPage 把一页kv按小端定长编码追加到dst
+func encodeRawPage(dst []byte, page []KVPair) []byte {
+	var b [16]byte
+	for _, kv := range page {
+		binary.LittleEndian.PutUint64(b[:], uint64(kv.Key))
+		binary.LittleEndian.PutUint64(b[8:], uint64(kv.Value))
+		dst = append(dst, b[:]...)
+	}
+	return dst
+}
+
+func decodeRawPage(b []byte) []KVPair {
+	page := make([]KVPair, len(b)/16)
+	for i := range page {
+		page[i].Key = int(binary.LittleEndian.Uint64(b[i*16:]))
+		page[i].Value = int(binary.LittleEndian.Uint64(b[i*16+8:]))
+	}
+	return page
+}
+
+// encodeDeltaPage 差值编码一页kv追加到dst
+// 格式: kv... | 重启点偏移(每个4字节) | 重启点个数(4字节)
+// 重启点kv: varint(key) varint(value)；其它kv: uvarint(key-前一个key) varint(value)
+func encodeDeltaPage(dst []byte, page []KVPair, restartInterval int) []byte {
+	base := len(dst)
+	restarts := make([]uint32, 0, len(page)/restartInterval+1)
+	var buf [binary.MaxVarintLen64]byte
+	for i, kv := range page {
+		var n int
+		if i%restartInterval == 0 {
+			restarts = append(restarts, uint32(len(dst)-base))
+			n = binary.PutVarint(buf[:], int64(kv.Key))
+		} else {
+			n = binary.PutUvarint(buf[:], uint64(kv.Key-page[i-1].Key))
+		}
+		dst = append(dst, buf[:n]...)
+		n = binary.PutVarint(buf[:], int64(kv.Value))
+		dst = append(dst, buf[:n]...)
+	}
+	var b [4]byte
+	for _, r := range restarts {
+		binary.LittleEndian.PutUint32(b[:], r)
+		dst = append(dst, b[:]...)
+	}
+	binary.LittleEndian.PutUint32(b[:], uint32(len(restarts)))
+	return append(dst, b[:]...)
+}
+
+// deltaPage 差值编码页的只读视图
+type deltaPage struct {
+	data     []byte // kv部分
+	restarts []byte // 重启点偏移
+}
+
+func newDeltaPage(b []byte) (deltaPage, error) {
+	if len(b) < 4 {
+		return deltaPage{}, errCorruptPage
+	}
+	n := uint64(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	if n*4+4 > uint64(len(b)) {
+		return deltaPage{}, errCorruptPage
+	}
+	end := uint64(len(b)) - 4 - n*4
+	return deltaPage{data: b[:end], restarts: b[end : len(b)-4]}, nil
+}
+
+func (p deltaPage) numRestarts() int {
+	return len(p.restarts) / 4
+}
+
+func (p deltaPage) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(p.restarts[i*4:]))
+}
+
+// next 从off处解码一个kv，prevKey是前一个key，重启点处忽略
+func (p deltaPage) next(off int, prevKey int, isRestart bool) (KVPair, int) {
+	var kv KVPair
+	var n int
+	if isRestart {
+		var k int64
+		k, n = binary.Varint(p.data[off:])
+		kv.Key = int(k)
+	} else {
+		var d uint64
+		d, n = binary.Uvarint(p.data[off:])
+		kv.Key = prevKey + int(d)
+	}
+	if n <= 0 {
+		panic(errCorruptPage)
+	}
+	off += n
+	v, n := binary.Varint(p.data[off:])
+	if n <= 0 {
+		panic(errCorruptPage)
+	}
+	kv.Value = int(v)
+	return kv, off + n
+}
+
+// decode 解码整页
+func (p deltaPage) decode() []KVPair {
+	page := make([]KVPair, 0, 16)
+	r := 0
+	var kv KVPair
+	for off := 0; off < len(p.data); {
+		isRestart := r < p.numRestarts() && off == p.restart(r)
+		if isRestart {
+			r++
+		}
+		kv, off = p.next(off, kv.Key, isRestart)
+		page = append(page, kv)
+	}
+	return page
+}
+
+// lookup 先二分查找最后一个不大于key的重启点，再顺序解码
+func (p deltaPage) lookup(key int) (int, bool) {
+	lo, hi := 0, p.numRestarts()
+	for lo < hi {
+		mid := (lo + hi) / 2
+		kv, _ := p.next(p.restart(mid), 0, true)
+		if kv.Key > key {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if lo == 0 {
+		return 0, false
+	}
+	r := lo - 1
+	off := p.restart(r)
+	end := len(p.data)
+	if r+1 < p.numRestarts() {
+		end = p.restart(r + 1)
+	}
+	var kv KVPair
+	for isRestart := true; off < end; isRestart = false {
+		kv, off = p.next(off, kv.Key, isRestart)
+		if kv.Key == key {
+			return kv.Value, true
+		}
+		if kv.Key > key {
+			break
+		}
+	}
+	return 0, false
+}
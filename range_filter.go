@@ -0,0 +1,88 @@
+package slsm
+
+// 范围查询跨越的前缀超过这个数就不再逐个探测
+const maxRangeFilterProbes = 32
+
+// RangeFilter 前缀布隆过滤器：把key右移shift位作为前缀加入布隆过滤器，
+// 查询[key1, key2)时探测覆盖的每个前缀，都不存在则run中一定没有这个范围的key
+type RangeFilter struct {
+	shift      uint8
+	bf         *BloomFilter
+	lastPrefix int
+	empty      bool
+}
+
+// NewRangeFilter new
+// @param shift - 前缀去掉的低位个数
+// @param n - 预估元素个数
+// @param p - 误判率
+func NewRangeFilter(shift uint8, n uint64, p float64) *RangeFilter {
+	return &RangeFilter{
+		shift: shift,
+		bf:    NewBloomFilter(n, p),
+		empty: true,
+	}
+}
+
+// SetHasher 设置hash函数和种子，必须在Add之前调用
+func (rf *RangeFilter) SetHasher(h Hasher, seed uint32) {
+	rf.bf.SetHasher(h, seed)
+}
+
+// Add 加入key，key递增时相同前缀只加入一次
+func (rf *RangeFilter) Add(key int) {
+	prefix := key >> rf.shift
+	if !rf.empty && prefix == rf.lastPrefix {
+		return
+	}
+	rf.bf.Add(encodeInt(prefix))
+	rf.lastPrefix = prefix
+	rf.empty = false
+}
+
+// MayContainRange [key1, key2)中是否可能有key
+func (rf *RangeFilter) MayContainRange(key1, key2 int) bool {
+	if key2 <= key1 {
+		return false
+	}
+	p1, p2 := key1>>rf.shift, (key2-1)>>rf.shift
+	if uint64(p2-p1) >= maxRangeFilterProbes {
+		return true
+	}
+	for p := p1; ; p++ {
+		if rf.bf.MayContain(encodeInt(p)) {
+			return true
+		}
+		if p == p2 {
+			return false
+		}
+	}
+}
+
+// MarshalBinary 编码: shift(1字节) | hash函数ID(1字节) | hash种子(4字节) | 布隆过滤器
+func (rf *RangeFilter) MarshalBinary() ([]byte, error) {
+	data, err := rf.bf.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := rf.bf.appendHash([]byte{rf.shift})
+	return append(b, data...), nil
+}
+
+func (rf *RangeFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] >= 64 {
+		return errCorruptFilter
+	}
+	bf := &BloomFilter{}
+	rest, err := bf.readHash(data[1:])
+	if err != nil {
+		return err
+	}
+	if err := bf.UnmarshalBinary(rest); err != nil {
+		return err
+	}
+	rf.shift = data[0]
+	rf.bf = bf
+	rf.empty = false
+	return nil
+}
@@ -0,0 +1,108 @@
+package slsm
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRangeFilter(t *testing.T) {
+	for _, shift := range []uint8{0, 4, 10} {
+		// 负数、接近最小最大值的key，按递增顺序加入
+		var keys []int
+		keys = append(keys, math.MinInt, math.MinInt+1)
+		for k := -100; k < 100; k++ {
+			keys = append(keys, k<<20)
+		}
+		keys = append(keys, math.MaxInt-1)
+		rf := NewRangeFilter(shift, uint64(len(keys)), 0.001)
+		for _, k := range keys {
+			rf.Add(k)
+		}
+		data, err := rf.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &RangeFilter{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range []*RangeFilter{rf, decoded} {
+			for _, k := range keys {
+				if !f.MayContainRange(k, k+1) {
+					t.Fatalf("shift %v: [%v, %v) should contain %v", shift, k, k+1, k)
+				}
+				// 范围只覆盖key所在前缀的一部分
+				lo := k >> shift << shift
+				if !f.MayContainRange(lo, k+1) {
+					t.Fatalf("shift %v: [%v, %v) should contain %v", shift, lo, k+1, k)
+				}
+			}
+			if f.MayContainRange(5, 5) || f.MayContainRange(5, 1) {
+				t.Fatalf("shift %v: empty range", shift)
+			}
+			// 跨越很多前缀时不逐个探测
+			if !f.MayContainRange(math.MinInt, math.MaxInt) || !f.MayContainRange(-1<<30, 1<<30) {
+				t.Fatalf("shift %v: wide range", shift)
+			}
+
+			// 与所有key的前缀都不相交的短范围大多被过滤
+			falsePositives := 0
+			for k := -100; k < 100; k++ {
+				lo := k<<20 + 1<<shift
+				if f.MayContainRange(lo, lo+3<<shift) {
+					falsePositives++
+				}
+			}
+			if falsePositives > 10 {
+				t.Fatalf("shift %v: %v of 200 disjoint ranges pass", shift, falsePositives)
+			}
+		}
+	}
+}
+
+// blockCacheAccesses 返回页缓存的访问次数
+func blockCacheAccesses(c *BlockCache) uint64 {
+	s := c.Stats()
+	return s.Hits + s.Misses
+}
+
+func TestRangeFilterSkipsRun(t *testing.T) {
+	for _, shift := range []uint8{0, 4} {
+		o := DefaultOptions()
+		o.Dir = t.TempDir()
+		o.EltsPerRun = 64
+		o.NumRuns = 2
+		o.PageSize = 16
+		o.PageEncoding = DeltaEncoding // 差值编码的页经过缓存，用缓存的访问次数统计读了多少页
+		o.BlockCache = NewBlockCache(1 << 20)
+		o.RangeFilterShift = shift
+		lsm := NewLSMWithOptions(o)
+		// 每1024个key中只有前16个
+		for k := 0; k < 200; k++ {
+			for j := 0; j < 16; j++ {
+				lsm.InsertKey(k<<10+j, j)
+			}
+		}
+		waitCompactions(lsm)
+
+		before := blockCacheAccesses(o.BlockCache)
+		for k := 0; k < 100; k++ {
+			if kvs := lsm.Range(k<<10+100, k<<10+200); len(kvs) != 0 {
+				t.Fatalf("shift %v: range in gap got %v", shift, kvs)
+			}
+		}
+		gapReads := blockCacheAccesses(o.BlockCache) - before
+		if shift > 0 && gapReads != 0 {
+			t.Fatalf("shift %v: %v page reads for ranges with no keys", shift, gapReads)
+		}
+		if shift == 0 && gapReads == 0 {
+			t.Fatalf("without range filter, ranges in gaps should read pages")
+		}
+
+		if kvs := lsm.Range(5<<10, 5<<10+8); len(kvs) != 8 {
+			t.Fatalf("shift %v: range got %v", shift, kvs)
+		}
+		lsm.Close()
+	}
+}
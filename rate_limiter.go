@@ -0,0 +1,102 @@
+package slsm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter 令牌桶限速器，限制后台合并读写磁盘的字节数，避免占满磁盘带宽影响前台的查找。
+// 可以在多个LSM之间共享，运行时用SetRate调整速度
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒字节数，0表示不限速
+	tokens float64 // 可以为负，表示已经预支的字节数
+	last   time.Time
+
+	bytes     int64 // 申请过的字节数
+	throttled int64 // 等待令牌的总时间(time.Duration)
+}
+
+// rateLimiterBurst 最多攒多长时间的令牌
+const rateLimiterBurst = 100 * time.Millisecond
+
+// NewRateLimiter bytesPerSec不大于0表示不限速
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	rl := &RateLimiter{last: time.Now()}
+	rl.SetRate(bytesPerSec)
+	return rl
+}
+
+// SetRate 修改每秒字节数，不大于0表示不限速。已经在等待的请求按原来的速度等待
+func (rl *RateLimiter) SetRate(bytesPerSec int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.refill(time.Now())
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	rl.rate = float64(bytesPerSec)
+	if rl.rate == 0 {
+		rl.tokens = 0
+	}
+}
+
+// Rate 返回当前的每秒字节数
+func (rl *RateLimiter) Rate() int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return int64(rl.rate)
+}
+
+// refill 按经过的时间补充令牌，必须持有rl.mu
+func (rl *RateLimiter) refill(now time.Time) {
+	if rl.rate > 0 {
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if burst := rateLimiterBurst.Seconds() * rl.rate; rl.tokens > burst {
+			rl.tokens = burst
+		}
+	}
+	rl.last = now
+}
+
+// Wait 申请n字节，令牌不够时等到补足为止。rl为nil时直接返回
+func (rl *RateLimiter) Wait(n int) {
+	if rl == nil || n <= 0 {
+		return
+	}
+	atomic.AddInt64(&rl.bytes, int64(n))
+	rl.mu.Lock()
+	if rl.rate == 0 {
+		rl.mu.Unlock()
+		return
+	}
+	rl.refill(time.Now())
+	rl.tokens -= float64(n)
+	var wait time.Duration
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+		atomic.AddInt64(&rl.throttled, int64(wait))
+	}
+}
+
+// RateLimiterStats 限速器的统计
+type RateLimiterStats struct {
+	Rate          int64         // 当前的每秒字节数
+	Bytes         int64         // 合并读写过的字节数
+	ThrottledTime time.Duration // 合并因为限速等待的总时间
+}
+
+// Stats 返回统计
+func (rl *RateLimiter) Stats() RateLimiterStats {
+	return RateLimiterStats{
+		Rate:          rl.Rate(),
+		Bytes:         atomic.LoadInt64(&rl.bytes),
+		ThrottledTime: time.Duration(atomic.LoadInt64(&rl.throttled)),
+	}
+}
@@ -0,0 +1,97 @@
+package slsm
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitBytes 分多次申请total字节，返回用时
+func waitBytes(rl *RateLimiter, total, chunk int) time.Duration {
+	start := time.Now()
+	for n := 0; n < total; n += chunk {
+		rl.Wait(chunk)
+	}
+	return time.Since(start)
+}
+
+// checkRate 检查申请total字节的用时和限速相符：开始时攒的令牌最多rateLimiterBurst
+func checkRate(t *testing.T, name string, elapsed time.Duration, total int, rate int64) {
+	t.Helper()
+	burst := rateLimiterBurst.Seconds() * float64(rate)
+	lo := time.Duration((float64(total) - burst) / float64(rate) * 0.9 * float64(time.Second))
+	hi := time.Duration(float64(total)/float64(rate)*1.5*float64(time.Second)) + 50*time.Millisecond
+	if elapsed < lo || elapsed > hi {
+		t.Fatalf("%v: %v bytes at %v B/s took %v, want [%v, %v]", name, total, rate, elapsed, lo, hi)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 4 << 20
+	const total = 1 << 20
+	rl := NewRateLimiter(rate)
+	checkRate(t, "single", waitBytes(rl, total, 4096), total, rate)
+	s := rl.Stats()
+	if s.Rate != rate || s.Bytes != total || s.ThrottledTime <= 0 {
+		t.Fatalf("stats %+v", s)
+	}
+
+	// 多个goroutine共享同一个限速
+	var wg sync.WaitGroup
+	start := time.Now()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waitBytes(rl, total/4, 4096)
+		}()
+	}
+	wg.Wait()
+	checkRate(t, "concurrent", time.Since(start), total, rate)
+	if s2 := rl.Stats(); s2.Bytes != 2*total || s2.ThrottledTime <= s.ThrottledTime {
+		t.Fatalf("stats %+v after %+v", s2, s)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var nilLimiter *RateLimiter
+	nilLimiter.Wait(1 << 20)
+
+	for _, rate := range []int64{0, -1} {
+		rl := NewRateLimiter(rate)
+		if elapsed := waitBytes(rl, 1<<30, 1<<20); elapsed > 100*time.Millisecond {
+			t.Fatalf("rate %v: 1GB took %v", rate, elapsed)
+		}
+		if s := rl.Stats(); s.Rate != 0 || s.Bytes != 1<<30 || s.ThrottledTime != 0 {
+			t.Fatalf("rate %v: stats %+v", rate, s)
+		}
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	// 64KB/s时1MB要十几秒，中途改成不限速后很快结束
+	rl := NewRateLimiter(64 << 10)
+	done := make(chan time.Duration)
+	go func() {
+		done <- waitBytes(rl, 1<<20, 16<<10)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	rl.SetRate(0)
+	select {
+	case elapsed := <-done:
+		if elapsed < 100*time.Millisecond {
+			t.Fatalf("finished in %v before SetRate", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("still throttled after SetRate(0)")
+	}
+	if rl.Rate() != 0 {
+		t.Fatalf("rate %v", rl.Rate())
+	}
+
+	// 从不限速改成限速，不会用不限速期间攒的令牌
+	time.Sleep(50 * time.Millisecond)
+	const rate = 2 << 20
+	rl.SetRate(rate)
+	checkRate(t, "after SetRate", waitBytes(rl, 512<<10, 4096), 512<<10, rate)
+}
@@ -1,6 +1,10 @@
 package slsm
 
-import "github.com/liwnn/skiplist"
+import (
+	"math"
+
+	"github.com/liwnn/skiplist"
+)
 
 type Run interface {
 	GetElementsNum() uint64
@@ -25,15 +29,15 @@ func (kv KVPair) Less(than skiplist.Item) bool {
 // MemRun 内存run
 type MemRun struct {
 	sl       *skiplist.SkipList
-	min, max int
+	min, max int // 插入过的最小、最大key；空run的min > max，任何key都不在范围内
 	size     int
 }
 
-func NewMemRun(minKey, maxKey int) *MemRun {
+func NewMemRun() *MemRun {
 	return &MemRun{
 		sl:  skiplist.New(),
-		min: minKey,
-		max: maxKey,
+		min: math.MaxInt,
+		max: math.MinInt,
 	}
 }
 
@@ -44,7 +48,8 @@ func (r *MemRun) SetSize(size uint64) {
 func (r *MemRun) InsertKey(kv KVPair) {
 	if kv.Key > r.max {
 		r.max = kv.Key
-	} else if kv.Key < r.min {
+	}
+	if kv.Key < r.min {
 		r.min = kv.Key
 	}
 
@@ -85,7 +90,7 @@ func (r MemRun) Lookup(key int) (int, bool) {
 }
 
 func (r MemRun) GetAllInRange(key1, key2 int) []KVPair {
-	if key1 > r.max || key2 < r.min {
+	if key1 > r.max || key2 <= r.min {
 		return nil
 	}
 
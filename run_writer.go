@@ -0,0 +1,197 @@
+package slsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// RunFormat run文件的格式
+type RunFormat struct {
+	Compressor      Compressor   // 页压缩算法，nil表示不压缩
+	Encoding        PageEncoding // 页内kv编码
+	RestartInterval int          // 差值编码的重启点间隔
+	Filter          FilterType   // 点查询过滤器
+	RangeShift      uint8        // 范围过滤器前缀去掉的低位个数，0表示没有范围过滤器
+	Hasher          Hasher       // 过滤器的hash函数，nil表示MurmurHash3
+	HashSeed        uint32       // 过滤器的hash种子
+}
+
+// runWriter 按页顺序写一个新的run文件，写完后得到只读的DiskRun
+type runWriter struct {
+	fd         *os.File
+	w          *bufio.Writer
+	filename   string
+	fileNum    uint64
+	pageSize   uint64
+	compressor Compressor
+	encoding   PageEncoding
+	restart    int // 差值编码的重启点间隔
+
+	page          []KVPair // 当前页
+	buf           []byte
+	pageLens      []uint64 // 已写页的字节数
+	fencePointers []int
+	bf            Filter
+	rangeFilter   *RangeFilter
+	maxKey        int
+	count         uint64
+	tombstones    uint64
+	limiter       *RateLimiter // 写入前申请字节数，nil表示不限速
+}
+
+// newRunWriter 创建文件编号为fileNum的run文件
+// @param capacity - 预估的kv个数，用于布隆过滤器
+// @param format - 文件格式
+func newRunWriter(dir string, fileNum uint64, capacity uint64, pageSize uint32, bffp float64, format RunFormat) *runWriter {
+	filename := runFileName(dir, fileNum)
+	fd, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		panic(err)
+	}
+	var rf *RangeFilter
+	if format.RangeShift > 0 {
+		rf = NewRangeFilter(format.RangeShift, capacity, bffp)
+		rf.SetHasher(format.Hasher, format.HashSeed)
+	}
+	return &runWriter{
+		fd:          fd,
+		w:           bufio.NewWriterSize(fd, 64<<10),
+		filename:    filename,
+		fileNum:     fileNum,
+		pageSize:    uint64(pageSize),
+		compressor:  format.Compressor,
+		encoding:    format.Encoding,
+		restart:     format.RestartInterval,
+		page:        make([]KVPair, 0, pageSize),
+		bf:          newFilterWithHash(format.Filter, capacity, bffp, format.Hasher, format.HashSeed),
+		rangeFilter: rf,
+	}
+}
+
+// Add 追加一个kv，key必须递增
+func (w *runWriter) Add(kv KVPair) {
+	if len(w.page) == 0 {
+		w.fencePointers = append(w.fencePointers, kv.Key)
+	}
+	w.page = append(w.page, kv)
+	w.bf.Add(encodeInt(kv.Key))
+	if w.rangeFilter != nil {
+		w.rangeFilter.Add(kv.Key)
+	}
+	w.maxKey = kv.Key
+	w.count++
+	if kv.Value == TOMBSTONE {
+		w.tombstones++
+	}
+	if uint64(len(w.page)) == w.pageSize {
+		w.flushPage()
+	}
+}
+
+func (w *runWriter) flushPage() {
+	if len(w.page) == 0 {
+		return
+	}
+	var b []byte
+	switch {
+	case w.encoding == RawEncoding && w.compressor == nil:
+		// 不压缩时直接写内存中的KVPair，打开后可以映射成[]KVPair
+		sz := int(unsafe.Sizeof(KVPair{}))
+		b = unsafe.Slice((*byte)(unsafe.Pointer(&w.page[0])), len(w.page)*sz)
+	case w.encoding == RawEncoding:
+		w.buf = encodeRawPage(w.buf[:0], w.page)
+		b = w.buf
+	case w.encoding == DeltaEncoding:
+		w.buf = encodeDeltaPage(w.buf[:0], w.page, w.restart)
+		b = w.buf
+	default:
+		panic(fmt.Errorf("slsm: unknown page encoding %v", w.encoding))
+	}
+	if w.compressor != nil {
+		b = w.compressor.Compress(nil, b)
+	}
+	w.write(b)
+	w.pageLens = append(w.pageLens, uint64(len(b)))
+	w.page = w.page[:0]
+}
+
+func (w *runWriter) write(b []byte) {
+	w.limiter.Wait(len(b))
+	if _, err := w.w.Write(b); err != nil {
+		panic(fmt.Errorf("write %v err[%v]", w.filename, err))
+	}
+}
+
+// Finish 写文件尾并刷盘，返回只读的DiskRun。没有写入任何kv时删除文件并返回nil
+func (w *runWriter) Finish() *DiskRun {
+	if w.count == 0 {
+		w.Abort()
+		return nil
+	}
+	w.flushPage()
+
+	bfData, err := marshalFilter(w.bf)
+	if err != nil {
+		panic(err)
+	}
+	w.write(bfData)
+	var rfData []byte
+	if w.rangeFilter != nil {
+		if rfData, err = w.rangeFilter.MarshalBinary(); err != nil {
+			panic(err)
+		}
+		w.write(rfData)
+	}
+
+	var id = NoCompression
+	if w.compressor != nil {
+		id = w.compressor.ID()
+	}
+	footer := []byte{id, byte(w.encoding)}
+	footer = appendUvarint(footer, w.count)
+	footer = appendUvarint(footer, w.tombstones)
+	footer = appendUvarint(footer, w.pageSize)
+	footer = appendUvarint(footer, uint64(len(w.pageLens)))
+	for _, n := range w.pageLens {
+		footer = appendUvarint(footer, n)
+	}
+	footer = appendVarint(footer, w.fencePointers[0])
+	footer = appendVarint(footer, w.maxKey)
+	for _, key := range w.fencePointers {
+		footer = appendVarint(footer, key)
+	}
+	footer = appendUvarint(footer, uint64(len(bfData)))
+	footer = appendUvarint(footer, uint64(len(rfData)))
+	var trailer [runTrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(footer)))
+	binary.LittleEndian.PutUint32(trailer[4:], runMagic)
+	footer = append(footer, trailer[:]...)
+	w.write(footer)
+	if err := w.w.Flush(); err != nil {
+		panic(fmt.Errorf("write %v err[%v]", w.filename, err))
+	}
+	if err := w.fd.Sync(); err != nil {
+		panic(fmt.Errorf("sync %v err[%v]", w.filename, err))
+	}
+
+	dr, err := mapDiskRun(w.fd, w.filename, w.fileNum)
+	if err != nil {
+		panic(fmt.Errorf("open %v err[%v]", w.filename, err))
+	}
+	// 直接使用内存中的布隆过滤器，不需要再解码
+	dr.bf = w.bf
+	dr.bfData = nil
+	dr.loadFilter()
+	return dr
+}
+
+// Abort 放弃写入并删除文件
+func (w *runWriter) Abort() {
+	w.fd.Close()
+	if err := os.Remove(w.filename); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,350 @@
+package slsm
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// compactionScheduler 后台合并的调度器。workers个goroutine每次挑选一个和正在执行的合并不冲突
+// (不同的层，或分区的分级层中不重叠的key范围)的合并执行，多个合并可以同时写文件。
+// 优先级：内存run的合并最高；其次是挡住了上面合并的层，越靠近内存run越先合并，它们不腾出空间写入最终会停下来；
+// 然后是已满的层，越满越先合并；最后是删除标记比例过高的run
+type compactionScheduler struct {
+	lsm *LSM
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	flushes []*compaction // 等待合并的内存run，只有kvs和done
+	running []*compaction
+	paused  int // 手动合并时暂停调度
+	closed  bool
+
+	// 写入限流
+	flushing   int    // 排队和正在执行的内存run合并个数
+	flushBytes uint64 // 排队和正在执行的内存run合并的字节数
+	level0Runs int
+	debtBytes  uint64 // 已满的层要合并到下一层的字节数
+	stall      WriteStallInfo
+
+	wg sync.WaitGroup
+}
+
+// newCompactionScheduler 启动workers个后台合并的goroutine，workers不大于0时为1
+func newCompactionScheduler(lsm *LSM, workers int) *compactionScheduler {
+	if workers <= 0 {
+		workers = 1
+	}
+	s := &compactionScheduler{lsm: lsm}
+	s.cond = sync.NewCond(&s.mu)
+	s.level0Runs, s.debtBytes = lsm.levelStats()
+	s.updateStall()
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	return s
+}
+
+func (s *compactionScheduler) worker() {
+	defer s.wg.Done()
+	lsm := s.lsm
+	for {
+		c := s.next()
+		if c == nil {
+			return
+		}
+		lsm.runCompaction(c)
+		lsm.diskMu.Lock()
+		lsm.installCompaction(c)
+		level0Runs, debt := lsm.levelStats()
+		lsm.diskMu.Unlock()
+		s.finish(c, level0Runs, debt)
+	}
+}
+
+// next 等待下一个可以执行的合并，关闭后返回nil
+func (s *compactionScheduler) next() *compaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed {
+		if s.paused == 0 {
+			s.lsm.diskMu.Lock()
+			c := s.pick()
+			s.lsm.diskMu.Unlock()
+			if c != nil {
+				s.running = append(s.running, c)
+				return c
+			}
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+// finish 合并安装后调用，更新限流状态
+func (s *compactionScheduler) finish(c *compaction, level0Runs int, debt uint64) {
+	s.mu.Lock()
+	for i, r := range s.running {
+		if r == c {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
+		}
+	}
+	if c.done != nil {
+		s.flushDone(c)
+	}
+	s.level0Runs, s.debtBytes = level0Runs, debt
+	s.updateStall()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// enqueueFlush 排队合并内存run，需要等待时先等待，见waitFlush。按调用的顺序写入第1层，
+// 内存run合并好后用flush设置kvs
+// @param bytes - 内存run的字节数
+func (s *compactionScheduler) enqueueFlush(bytes uint64) *compaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.waitFlush() {
+		s.cond.Wait()
+	}
+	f := &compaction{done: make(chan struct{}), pendingBytes: bytes}
+	s.flushes = append(s.flushes, f)
+	s.flushing++
+	s.flushBytes += bytes
+	s.updateStall()
+	return f
+}
+
+// flush 设置enqueueFlush排队的内存run合并后的kvs，返回时已经写入manifest
+func (s *compactionScheduler) flush(f *compaction, kvs []KVPair) {
+	s.mu.Lock()
+	f.kvs, f.ready = kvs, true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-f.done
+}
+
+// flushDone 内存run的合并完成，必须持有s.mu
+func (s *compactionScheduler) flushDone(f *compaction) {
+	s.flushing--
+	s.flushBytes -= f.pendingBytes
+	close(f.done)
+}
+
+// flushesDone 返回已经排队和正在执行的内存run合并的done，都关闭后它们已经写入第1层
+func (s *compactionScheduler) flushesDone() []chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var done []chan struct{}
+	for _, f := range s.flushes {
+		done = append(done, f.done)
+	}
+	for _, c := range s.running {
+		if c.done != nil {
+			done = append(done, c.done)
+		}
+	}
+	return done
+}
+
+// pause 等正在执行的合并结束并暂停调度，手动合并期间独占磁盘层
+func (s *compactionScheduler) pause() {
+	s.mu.Lock()
+	s.paused++
+	for len(s.running) > 0 {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+}
+
+// resume 手动合并的一步结束后恢复调度，调用时不能持有diskMu
+func (s *compactionScheduler) resume() {
+	s.lsm.diskMu.RLock()
+	level0Runs, debt := s.lsm.levelStats()
+	s.lsm.diskMu.RUnlock()
+
+	s.mu.Lock()
+	s.level0Runs, s.debtBytes = level0Runs, debt
+	s.updateStall()
+	s.paused--
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// close 等正在执行的合并结束后停止所有goroutine，没开始的合并不再执行
+func (s *compactionScheduler) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// busy dl中[lo, hi]范围内的run是否被正在执行的合并占用
+func (s *compactionScheduler) busy(dl *DiskLevel, lo, hi int) bool {
+	for _, o := range s.running {
+		if (dl == o.src || dl == o.dst) && lo <= o.hi && o.lo <= hi {
+			return true
+		}
+		for _, t := range o.through {
+			if dl == t && lo <= o.hi && o.lo <= hi {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *compactionScheduler) conflicts(c *compaction) bool {
+	if (c.src != nil && s.busy(c.src, c.lo, c.hi)) || s.busy(c.dst, c.lo, c.hi) {
+		return true
+	}
+	for _, t := range c.through {
+		if s.busy(t, c.lo, c.hi) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick 挑选下一个可以执行的合并，没有时返回nil。必须持有s.mu和diskMu的写锁
+func (s *compactionScheduler) pick() *compaction {
+	lsm := s.lsm
+	// need[i] 下标为i的层挡住了上面的合并，要腾出的kv个数
+	need := make([]uint64, len(lsm.diskLevels))
+	for len(s.flushes) > 0 && s.flushes[0].ready && len(s.flushes[0].kvs) == 0 {
+		s.flushDone(s.flushes[0])
+		s.flushes = s.flushes[1:]
+		s.updateStall()
+		s.cond.Broadcast()
+	}
+	if len(s.flushes) > 0 && s.flushes[0].ready {
+		f := s.flushes[0]
+		n := uint64(len(f.kvs))
+		if lsm.levelFull(0, n) {
+			need[0] = n
+		} else if c := lsm.planMerge(0, nil, f.kvs); !s.conflicts(c) {
+			c.done, c.pendingBytes = f.done, f.pendingBytes
+			s.flushes = s.flushes[1:]
+			return c
+		}
+	}
+	// 第1层的run太多会让写入减速或停止，即使没满也合并下去
+	if t := lsm.opts.level0Trigger(); t > 0 && len(lsm.diskLevels[0].runs) >= t && need[0] == 0 {
+		need[0] = 1
+	}
+
+	type candidate struct {
+		i        int
+		inputs   []*DiskRun
+		blocking bool
+		score    float64
+	}
+	var cands []candidate
+	for i := range lsm.diskLevels {
+		score := lsm.compactionScore(i)
+		if need[i] == 0 && score < 1 {
+			continue
+		}
+		inputs := lsm.selectInputs(i, need[i])
+		if len(inputs) == 0 {
+			continue
+		}
+		var incoming uint64
+		for _, r := range inputs {
+			incoming += r.GetCapacity()
+		}
+		if i+1 < len(lsm.diskLevels) && lsm.levelFull(i+1, incoming) {
+			need[i+1] = incoming
+			continue
+		}
+		cands = append(cands, candidate{i, inputs, need[i] > 0, score})
+	}
+	sort.SliceStable(cands, func(a, b int) bool {
+		if cands[a].blocking != cands[b].blocking {
+			return cands[a].blocking
+		}
+		return !cands[a].blocking && cands[a].score > cands[b].score
+	})
+
+	for _, cd := range cands {
+		src := lsm.diskLevels[cd.i]
+		lo, hi := math.MinInt, math.MaxInt
+		if lsm.partitioned(cd.i) {
+			lo, hi = runsHull(cd.inputs)
+		}
+		if s.busy(src, lo, hi) {
+			continue
+		}
+		if cd.i+1 == len(lsm.diskLevels) {
+			lsm.addDiskLevel()
+		}
+		c := lsm.planMerge(cd.i+1, cd.inputs, nil)
+		if s.conflicts(c) {
+			continue
+		}
+		if lsm.partitioned(cd.i) {
+			src.compactPointer = cd.inputs[len(cd.inputs)-1].maxKey
+		}
+		return c
+	}
+	if c := s.pickResize(); c != nil {
+		return c
+	}
+	return s.pickTombstones()
+}
+
+// pickResize 动态层大小时增减层，最下面两层没有被占用时才规划
+func (s *compactionScheduler) pickResize() *compaction {
+	lsm := s.lsm
+	bi := len(lsm.diskLevels) - 1
+	if s.busy(lsm.diskLevels[bi], math.MinInt, math.MaxInt) ||
+		(bi > 0 && s.busy(lsm.diskLevels[bi-1], math.MinInt, math.MaxInt)) {
+		return nil
+	}
+	return lsm.planResize()
+}
+
+// pickTombstones 从上往下找删除标记比例达到TombstoneCompactionRatio的run，不管层是否已满都丢弃它的删除标记，
+// 见planDropTombstones；在最下面一层时改写与它重叠的run。不会增加层
+func (s *compactionScheduler) pickTombstones() *compaction {
+	lsm := s.lsm
+	ratio := lsm.opts.TombstoneCompactionRatio
+	if ratio <= 0 {
+		return nil
+	}
+	bi := len(lsm.diskLevels) - 1
+	for i, dl := range lsm.diskLevels {
+		for idx, r := range dl.runs {
+			if r.GetTombstones() == 0 || r.tombstoneRatio() < ratio || s.busy(dl, r.minKey, r.maxKey) {
+				continue
+			}
+			var c *compaction
+			if i == bi {
+				c = lsm.planRewrite(r.minKey, r.maxKey, nil)
+			} else if c = lsm.planDropTombstones(i, idx); c == nil {
+				continue
+			}
+			if !s.conflicts(c) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// runsHull 返回runs的key范围的并集[lo, hi]
+func runsHull(runs []*DiskRun) (int, int) {
+	lo, hi := math.MaxInt, math.MinInt
+	for _, r := range runs {
+		if r.minKey < lo {
+			lo = r.minKey
+		}
+		if r.maxKey > hi {
+			hi = r.maxKey
+		}
+	}
+	return lo, hi
+}
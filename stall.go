@@ -0,0 +1,132 @@
+package slsm
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// DefaultWriteDelay 没有设置Options.WriteDelay时，刚达到减速阈值时每次写入的延迟
+const DefaultWriteDelay = 10 * time.Microsecond
+
+// kvSize 一个kv在内存和不压缩的run中占的字节数，用于估算等待合并的字节数
+const kvSize = uint64(unsafe.Sizeof(KVPair{}))
+
+// WriteStallCondition 写入的限流状态
+type WriteStallCondition int
+
+const (
+	WriteStallNormal  WriteStallCondition = iota // 不限流
+	WriteStallDelayed                            // 每次写入延迟一段时间
+	WriteStallStopped                            // 达到Stop*阈值，内存run写满后停止写入，直到后台合并跟上
+)
+
+func (c WriteStallCondition) String() string {
+	switch c {
+	case WriteStallNormal:
+		return "normal"
+	case WriteStallDelayed:
+		return "delayed"
+	case WriteStallStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("WriteStallCondition(%d)", int(c))
+}
+
+// WriteStallInfo 写入限流的状态和触发它的指标
+type WriteStallInfo struct {
+	Condition WriteStallCondition
+	// 等待合并的字节数：已经交给后台还没写入第1层的内存run，加上已满的层要合并到下一层的数据
+	PendingBytes uint64
+	Level0Runs   int           // 第1层的run个数
+	Delay        time.Duration // 每次写入的延迟
+}
+
+// stallRatio x达到limit的程度，limit为0表示不限制
+func stallRatio(x, limit uint64) float64 {
+	if limit == 0 {
+		return 0
+	}
+	return float64(x) / float64(limit)
+}
+
+// levelStats 返回第1层的run个数和已满的层要合并到下一层的字节数，必须持有diskMu
+func (lsm *LSM) levelStats() (int, uint64) {
+	var debt uint64
+	for i := range lsm.diskLevels {
+		if lsm.compactionScore(i) < 1 {
+			continue
+		}
+		for _, r := range lsm.selectInputs(i, 0) {
+			debt += r.GetCapacity() * kvSize
+		}
+	}
+	return len(lsm.diskLevels[0].runs), debt
+}
+
+// level0Trigger 第1层的run个数达到它时即使没满也要合并到下一层，否则可能一直停止写入。0表示没有限制
+func (o *Options) level0Trigger() int {
+	if o.SlowdownLevel0Runs > 0 && (o.StopLevel0Runs == 0 || o.SlowdownLevel0Runs < o.StopLevel0Runs) {
+		return o.SlowdownLevel0Runs
+	}
+	return o.StopLevel0Runs
+}
+
+// stopped 按当前指标是否达到了设置的停止写入阈值
+func (s *compactionScheduler) stopped(info WriteStallInfo) bool {
+	o := s.lsm.opts
+	return (o.StopPendingBytes > 0 && info.PendingBytes >= o.StopPendingBytes) ||
+		(o.StopLevel0Runs > 0 && info.Level0Runs >= o.StopLevel0Runs)
+}
+
+// waitFlush 内存run写满时是否要等待。除了停止写入，没有设置StopPendingBytes时还要等上一次内存run的合并完成，
+// 这是正常的反压，不算限流，不改变Condition。必须持有s.mu
+func (s *compactionScheduler) waitFlush() bool {
+	return s.stall.Condition == WriteStallStopped || (s.lsm.opts.StopPendingBytes == 0 && s.flushing > 0)
+}
+
+// updateStall 重新计算写入限流的状态，状态变化时调用OnWriteStall。必须持有s.mu
+func (s *compactionScheduler) updateStall() {
+	o := s.lsm.opts
+	info := WriteStallInfo{PendingBytes: s.flushBytes + s.debtBytes, Level0Runs: s.level0Runs}
+	if s.stopped(info) {
+		info.Condition = WriteStallStopped
+	} else {
+		// 超过减速阈值越多，延迟越长
+		r := stallRatio(info.PendingBytes, o.SlowdownPendingBytes)
+		if l0 := stallRatio(uint64(info.Level0Runs), uint64(o.SlowdownLevel0Runs)); l0 > r {
+			r = l0
+		}
+		if r >= 1 {
+			delay := o.WriteDelay
+			if delay <= 0 {
+				delay = DefaultWriteDelay
+			}
+			info.Condition = WriteStallDelayed
+			info.Delay = time.Duration(r * float64(delay))
+		}
+	}
+	atomic.StoreInt64(&s.lsm.writeDelay, int64(info.Delay))
+	prev := s.stall
+	s.stall = info
+	if info.Condition != prev.Condition && o.OnWriteStall != nil {
+		o.OnWriteStall(info)
+	}
+}
+
+// WriteStall 返回当前写入限流的状态
+func (lsm *LSM) WriteStall() WriteStallInfo {
+	lsm.sched.mu.Lock()
+	defer lsm.sched.mu.Unlock()
+	return lsm.sched.stall
+}
+
+// delayWrite 累计每次写入的延迟，攒够1毫秒再睡，太短的Sleep不准
+func (lsm *LSM) delayWrite(d time.Duration) {
+	lsm.delayed += d
+	if lsm.delayed >= time.Millisecond {
+		time.Sleep(lsm.delayed)
+		lsm.delayed = 0
+	}
+}
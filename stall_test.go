@@ -0,0 +1,65 @@
+package slsm
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestWriteStallNoLimits(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 100
+	o.NumRuns = 2
+	o.DiskRunsPerLevel = 4
+	var mu sync.Mutex
+	var events []WriteStallInfo
+	o.OnWriteStall = func(info WriteStallInfo) {
+		mu.Lock()
+		events = append(events, info)
+		mu.Unlock()
+	}
+	lsm := NewLSMWithOptions(o)
+	defer lsm.Close()
+	for i := 0; i < 20000; i++ {
+		lsm.InsertKey(i, i)
+		if i%100 == 0 {
+			if c := lsm.WriteStall().Condition; c != WriteStallNormal {
+				t.Fatalf("condition %v without limits", c)
+			}
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) > 0 {
+		t.Fatalf("%v write stall callbacks without limits, first %+v", len(events), events[0])
+	}
+}
+
+func TestWriteStallStopLimit(t *testing.T) {
+	o := DefaultOptions()
+	o.Dir = t.TempDir()
+	o.EltsPerRun = 100
+	o.NumRuns = 2
+	o.DiskRunsPerLevel = 4
+	o.StopPendingBytes = 4 * 200 * kvSize
+	o.SlowdownPendingBytes = 2 * 200 * kvSize
+	o.RateLimiter = NewRateLimiter(2 << 20) // 让合并跟不上写入
+	var mu sync.Mutex
+	seen := make(map[WriteStallCondition]int)
+	o.OnWriteStall = func(info WriteStallInfo) {
+		mu.Lock()
+		seen[info.Condition]++
+		mu.Unlock()
+	}
+	lsm := NewLSMWithOptions(o)
+	for i := 0; i < 20000; i++ {
+		lsm.InsertKey(i, i)
+	}
+	waitCompactions(lsm)
+	lsm.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if seen[WriteStallStopped] == 0 || seen[WriteStallNormal] == 0 {
+		t.Fatalf("write stall callbacks %v", seen)
+	}
+}
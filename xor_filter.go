@@ -0,0 +1,217 @@
+package slsm
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// XorFilter xor过滤器(Graf & Lemire, 2020)，按误判率选择8位或16位指纹。
+// 只能一次性构建：Add先收集key的hash，第一次查询或序列化时构建，之后不能再Add。
+// 8位指纹每个key约9.84位，误判率约1/256；16位指纹每个key约19.7位，误判率约1/65536。
+// 适合构建后不再修改的磁盘run
+type XorFilter struct {
+	filterHash
+	hashes       []uint64 // 构建前收集的hash
+	seed         uint64
+	blockLength  uint32
+	fpBits       uint8  // 指纹位数，8或16，0表示不过滤
+	fingerprints []byte // 每个指纹fpBits/8字节(小端)
+	built        bool
+}
+
+// NewXorFilter new
+// @param n - 预估元素个数
+// @param p - 误判率，不小于1/256时用8位指纹，否则用16位，不小于1时不过滤
+func NewXorFilter(n uint64, p float64) *XorFilter {
+	f := &XorFilter{hashes: make([]uint64, 0, n), fpBits: 16}
+	if p >= 1 {
+		f.fpBits = 0
+	} else if p >= 1.0/256 {
+		f.fpBits = 8
+	}
+	return f
+}
+
+func (f *XorFilter) keyHash(key []byte) uint64 {
+	h1, _ := f.sum(key)
+	return h1
+}
+
+func (f *XorFilter) Add(key []byte) {
+	if f.built {
+		panic("slsm: add to a built xor filter")
+	}
+	f.hashes = append(f.hashes, f.keyHash(key))
+}
+
+func (f *XorFilter) MayContain(key []byte) bool {
+	f.build()
+	if f.fpBits == 0 {
+		return true
+	}
+	if f.blockLength == 0 {
+		return false
+	}
+	h := fmix64(f.keyHash(key) + f.seed)
+	h0, h1, h2 := f.positions(h)
+	return f.fingerprint(h) == f.get(h0)^f.get(h1)^f.get(h2)
+}
+
+// fingerprint 取hash的低fpBits位作为指纹
+func (f *XorFilter) fingerprint(h uint64) uint16 {
+	h ^= h >> 32
+	if f.fpBits == 8 {
+		return uint16(uint8(h))
+	}
+	return uint16(h)
+}
+
+func (f *XorFilter) get(i uint32) uint16 {
+	if f.fpBits == 8 {
+		return uint16(f.fingerprints[i])
+	}
+	return binary.LittleEndian.Uint16(f.fingerprints[2*i:])
+}
+
+func (f *XorFilter) set(i uint32, fp uint16) {
+	if f.fpBits == 8 {
+		f.fingerprints[i] = uint8(fp)
+		return
+	}
+	binary.LittleEndian.PutUint16(f.fingerprints[2*i:], fp)
+}
+
+// reduce 把hash映射到[0, n)
+func reduce(h uint32, n uint32) uint32 {
+	return uint32(uint64(h) * uint64(n) >> 32)
+}
+
+func (f *XorFilter) positions(h uint64) (uint32, uint32, uint32) {
+	h0 := reduce(uint32(h), f.blockLength)
+	h1 := reduce(uint32(rotl64(h, 21)), f.blockLength) + f.blockLength
+	h2 := reduce(uint32(rotl64(h, 42)), f.blockLength) + 2*f.blockLength
+	return h0, h1, h2
+}
+
+// build 剥离(peeling)构建，失败时换seed重试
+func (f *XorFilter) build() {
+	if f.built {
+		return
+	}
+	f.built = true
+	keys := f.hashes
+	f.hashes = nil
+	if f.fpBits == 0 {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	n := 0
+	for i := range keys {
+		if i == 0 || keys[i] != keys[i-1] {
+			keys[n] = keys[i]
+			n++
+		}
+	}
+	keys = keys[:n]
+	if n == 0 {
+		return
+	}
+
+	capacity := 32 + uint32(1.23*float64(n))
+	f.blockLength = capacity / 3
+	capacity = f.blockLength * 3
+	f.fingerprints = make([]byte, capacity*uint32(f.fpBits/8))
+
+	type slot struct {
+		mask  uint64 // 落在这个位置的hash的异或
+		count uint32
+	}
+	type peeled struct {
+		hash  uint64
+		index uint32
+	}
+	slots := make([]slot, capacity)
+	queue := make([]uint32, 0, capacity)
+	stack := make([]peeled, 0, n)
+	for attempt := uint64(1); ; attempt++ {
+		f.seed = fmix64(attempt)
+		for i := range slots {
+			slots[i] = slot{}
+		}
+		for _, k := range keys {
+			h := fmix64(k + f.seed)
+			h0, h1, h2 := f.positions(h)
+			for _, p := range [3]uint32{h0, h1, h2} {
+				slots[p].mask ^= h
+				slots[p].count++
+			}
+		}
+		queue = queue[:0]
+		for i := range slots {
+			if slots[i].count == 1 {
+				queue = append(queue, uint32(i))
+			}
+		}
+		stack = stack[:0]
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			if slots[i].count != 1 {
+				continue
+			}
+			h := slots[i].mask
+			stack = append(stack, peeled{hash: h, index: i})
+			h0, h1, h2 := f.positions(h)
+			for _, p := range [3]uint32{h0, h1, h2} {
+				slots[p].mask ^= h
+				slots[p].count--
+				if slots[p].count == 1 {
+					queue = append(queue, p)
+				}
+			}
+		}
+		if len(stack) == n {
+			break
+		}
+	}
+
+	// 按剥离的逆序赋值，保证每个key的三个位置异或等于指纹
+	for i := len(stack) - 1; i >= 0; i-- {
+		h := stack[i].hash
+		h0, h1, h2 := f.positions(h)
+		f.set(stack[i].index, 0)
+		f.set(stack[i].index, f.fingerprint(h)^f.get(h0)^f.get(h1)^f.get(h2))
+	}
+}
+
+// MarshalBinary 编码: 指纹位数(1字节) | seed(8字节) | blockLength(uvarint) | 指纹(小端)
+func (f *XorFilter) MarshalBinary() ([]byte, error) {
+	f.build()
+	data := make([]byte, 9, 9+binary.MaxVarintLen32+len(f.fingerprints))
+	data[0] = f.fpBits
+	binary.LittleEndian.PutUint64(data[1:], f.seed)
+	data = appendUvarint(data, uint64(f.blockLength))
+	return append(data, f.fingerprints...), nil
+}
+
+func (f *XorFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 9 {
+		return errCorruptFilter
+	}
+	fpBits := data[0]
+	if fpBits != 0 && fpBits != 8 && fpBits != 16 {
+		return errCorruptFilter
+	}
+	seed := binary.LittleEndian.Uint64(data[1:])
+	blockLength, k := binary.Uvarint(data[9:])
+	if k <= 0 || uint64(len(data)-9-k) != blockLength*3*uint64(fpBits/8) {
+		return errCorruptFilter
+	}
+	f.fpBits = fpBits
+	f.seed = seed
+	f.blockLength = uint32(blockLength)
+	f.fingerprints = append([]byte(nil), data[9+k:]...)
+	f.hashes = nil
+	f.built = true
+	return nil
+}